@@ -1,12 +1,10 @@
 #!/bin/sh
 
-rm -f results.txt
+# usage: bench.sh <max index> <graph file prefix> [params preset]
+# writes one JSON object per index to results.json
+rm -f results.json
 
 for ((i=1;i<=$1;i++));
 do
-    $GOPATH/bin/spacecoin -index=$i -file $2$i -mode gen >> results.txt
-    $GOPATH/bin/spacecoin -index=$i -file $2$i -mode commit >> results.txt
-    $GOPATH/bin/spacecoin -index=$i -file $2$i -mode check >> results.txt
-    du -hc -B 1024 $2$i | grep total >> results.txt
-    echo $'\n' >> results.txt
+    $GOPATH/bin/spacecoin -index=$i -file $2$i -mode bench -params ${3:-default} >> results.json
 done
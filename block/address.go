@@ -0,0 +1,73 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/kwonalbert/spacemint/util"
+	"golang.org/x/crypto/sha3"
+)
+
+// Defines addresses: what outputs pay to, in a form people can copy.
+//
+// An output pays the hash of a public key, which the input spending it
+// reveals. An address is, in base58,
+//     prefix    byte      tells networks apart; see ChainParams
+//     hash      [20]byte  see PkHash
+//     checksum  [4]byte   start of the double hash of prefix and hash
+// so a mistyped address, or one for another network, is refused
+// rather than paid.
+
+const (
+	PkHashLen   = 20
+	checksumLen = 4
+)
+
+// return: the hash of encoded public key pk that outputs pay to
+func PkHash(pk []byte) []byte {
+	h := sha3.Sum256(pk)
+	return h[:PkHashLen]
+}
+
+func checksum(b []byte) []byte {
+	h := sha3.Sum256(b)
+	h = sha3.Sum256(h[:])
+	return h[:checksumLen]
+}
+
+// return: the address on network p of the pk hash hash
+func (p *ChainParams) EncodeAddress(hash []byte) string {
+	b := append([]byte{p.AddressPrefix}, hash...)
+	return util.EncodeBase58(append(b, checksum(b)...))
+}
+
+// return: the address on network p of encoded public key pk
+func (p *ChainParams) Address(pk []byte) string {
+	return p.EncodeAddress(PkHash(pk))
+}
+
+// return: the pk hash in address s, if s is an address on network p
+func (p *ChainParams) DecodeAddress(s string) ([]byte, error) {
+	b, err := util.DecodeBase58(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 1+PkHashLen+checksumLen {
+		return nil, errors.New("block: address has the wrong length")
+	}
+	body := b[:1+PkHashLen]
+	if !bytes.Equal(checksum(body), b[1+PkHashLen:]) {
+		return nil, errors.New("block: address has a bad checksum")
+	}
+	if b[0] != p.AddressPrefix {
+		return nil, fmt.Errorf("block: address is not for %s", p.Name)
+	}
+	return body[1:], nil
+}
+
+// Check that s is an address on network p
+func (p *ChainParams) ValidateAddress(s string) error {
+	_, err := p.DecodeAddress(s)
+	return err
+}
@@ -2,30 +2,37 @@ package block
 
 import (
 	"crypto"
-	"crypto/rand"
-	"encoding/json"
+	"fmt"
 	"github.com/kwonalbert/spacemint/pos"
 	"github.com/kwonalbert/spacemint/util"
 	"golang.org/x/crypto/sha3"
 )
 
 type Block struct {
-	Id    int
-	Hash  Hash
-	Trans []Transaction
-	Sig   Signature
+	Header
+	Body
+}
+
+// What a block commits to. Headers are small, so they can be synced
+// and checked before the bodies.
+type Header struct {
+	Prev      []byte  // id of the previous block
+	Id        int     // height of the block
+	TxRoot    []byte  // merkle root of the transaction ids
+	ProofHash []byte  // hash of the proof of space in the body
+	Quality   float64 // quality of the proof
+	Sig       Signature
 }
 
-type Hash struct {
-	Hash  []byte // hash of previous block
+type Body struct {
 	Proof PoS
+	Trans []Transaction
 }
 
 type PoS struct {
 	Commit    pos.Commitment
-	Challenge []byte  // this round's challenge
-	Answer    Answer  // answer to the challenge and proof
-	Quality   float64 // quality of the answer
+	Challenge []byte // this round's challenge
+	Answer    Answer // answer to the challenge and proof
 }
 
 type Answer struct {
@@ -37,65 +44,229 @@ type Answer struct {
 }
 
 type Signature struct {
-	Tsig []byte // signature on transaction i
+	Tsig []byte // signature on header i (see tsigMessage)
 	Ssig []byte // signature on signature i-1
 }
 
 func NewBlock(old *Block, prf PoS, ts []Transaction, signer crypto.Signer) *Block {
-	oldH, err := old.Hash.MarshalBinary()
+	root, err := TxRoot(ts)
 	if err != nil {
 		panic(err)
 	}
-	prevHash := sha3.Sum256(oldH)
-	h := Hash{
-		Hash:  prevHash[:],
-		Proof: prf,
+	b := Block{
+		Header: Header{
+			Prev:      old.ID(),
+			Id:        old.Id + 1,
+			TxRoot:    root,
+			ProofHash: prf.Hash(),
+			Quality:   Quality(&prf.Answer),
+		},
+		Body: Body{
+			Proof: prf,
+			Trans: ts,
+		},
 	}
 
-	var tsBytes []byte
-	for i := range ts {
-		b, err := ts[i].MarshalBinary()
-		if err != nil {
-			panic(err)
-		}
-		tsBytes = append(tsBytes, b...)
-	}
 	sigBytes := util.Concat([][]byte{old.Sig.Tsig, old.Sig.Ssig})
-
-	tsig, err := signer.Sign(rand.Reader, tsBytes, crypto.SHA3_256)
+	tsig, err := Sign(signer, tsigMessage(&b.Header))
 	if err != nil {
 		panic(err)
 	}
-	ssig, err := signer.Sign(rand.Reader, sigBytes, crypto.SHA3_256)
+	ssig, err := Sign(signer, sigBytes)
 	if err != nil {
 		panic(err)
 	}
-	sig := Signature{
+	b.Sig = Signature{
 		Tsig: tsig,
 		Ssig: ssig,
 	}
+	return &b
+}
 
-	b := Block{
-		Id:    old.Id + 1,
-		Hash:  h,
-		Trans: ts,
-		Sig:   sig,
+// return: the merkle root of the ids of ts
+func TxRoot(ts []Transaction) ([]byte, error) {
+	ids := make([][]byte, len(ts))
+	for i := range ts {
+		bin, err := ts[i].MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("%v in transaction %d", err, i)
+		}
+		id := sha3.Sum256(bin)
+		ids[i] = id[:]
 	}
-	return &b
+	return MerkleRoot(ids), nil
 }
 
-func (b *Block) MarshalBinary() ([]byte, error) {
-	return json.Marshal(b)
+// return: the unique identifier of the block; the hash of its header,
+//         which the next block links to
+func (h *Header) ID() []byte {
+	bin, _ := h.MarshalBinary()
+	id := sha3.Sum256(bin)
+	return id[:]
 }
 
-func (b *Block) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, b)
+// return: what Tsig signs; all of the header but the signatures.
+//         Signing two of these for the same height is what gets a
+//         miner punished.
+func tsigMessage(h *Header) []byte {
+	e := new(encoder)
+	e.int(h.Id)
+	e.bytes(h.Prev)
+	e.bytes(h.TxRoot)
+	e.bytes(h.ProofHash)
+	e.float64(h.Quality)
+	return e.Bytes()
+}
+
+// return: the height a message from tsigMessage is for
+func tsigHeight(m []byte) (int, error) {
+	d := &decoder{data: m}
+	id := d.int()
+	d.bytes()
+	d.bytes()
+	d.bytes()
+	d.float64()
+	return id, d.finish()
+}
+
+// The block encoding below is used both for hashing and for storage.
+// A header starts with blockVersion, which covers the whole block:
+//     header  bytes     see Header.MarshalBinary
+//     proof   PoS       see PoS.MarshalBinary
+//     trans   list of transaction encodings
+// json.Marshal of a block gives a readable form for export, but it is
+// never hashed or stored.
+
+// version of the block encoding
+const blockVersion = 1
+
+func (h *Header) MarshalBinary() ([]byte, error) {
+	e := new(encoder)
+	e.uint8(blockVersion)
+	e.buf.Write(tsigMessage(h))
+	e.bytes(h.Sig.Tsig)
+	e.bytes(h.Sig.Ssig)
+	return e.Bytes(), nil
+}
+
+func (h *Header) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	if v := d.uint8(); d.err == nil && v != blockVersion {
+		return fmt.Errorf("block: unknown block version %d", v)
+	}
+	res := Header{
+		Id:        d.int(),
+		Prev:      d.bytes(),
+		TxRoot:    d.bytes(),
+		ProofHash: d.bytes(),
+		Quality:   d.float64(),
+	}
+	res.Sig.Tsig = d.bytes()
+	res.Sig.Ssig = d.bytes()
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*h = res
+	return nil
+}
+
+// return: the hash of the proof, which the header commits to
+func (p *PoS) Hash() []byte {
+	bin, _ := p.MarshalBinary()
+	h := sha3.Sum256(bin)
+	return h[:]
+}
+
+func (p *PoS) MarshalBinary() ([]byte, error) {
+	e := new(encoder)
+	p.encode(e)
+	return e.Bytes(), nil
 }
 
-func (h *Hash) MarshalBinary() ([]byte, error) {
-	return json.Marshal(h)
+func (p *PoS) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	var res PoS
+	res.decode(d)
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*p = res
+	return nil
+}
+
+func (p *PoS) encode(e *encoder) {
+	e.bytes(p.Commit.Pk)
+	e.bytes(p.Commit.Commit)
+	e.bytes(p.Challenge)
+	a := &p.Answer
+	e.uint64(uint64(a.Size))
+	e.list(a.Hashes)
+	e.lists(a.Parents)
+	e.lists(a.Proofs)
+	e.uint32(uint32(len(a.PProofs)))
+	for _, ls := range a.PProofs {
+		e.lists(ls)
+	}
 }
 
-func (h *Hash) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, h)
+func (p *PoS) decode(d *decoder) {
+	p.Commit.Pk = d.bytes()
+	p.Commit.Commit = d.bytes()
+	p.Challenge = d.bytes()
+	a := &p.Answer
+	a.Size = int64(d.uint64())
+	a.Hashes = d.list()
+	a.Parents = d.lists()
+	a.Proofs = d.lists()
+	if n := d.count(4); n > 0 {
+		a.PProofs = make([][][][]byte, n)
+		for i := range a.PProofs {
+			a.PProofs[i] = d.lists()
+		}
+	}
+}
+
+func (b *Block) MarshalBinary() ([]byte, error) {
+	e := new(encoder)
+	hbin, _ := b.Header.MarshalBinary()
+	e.bytes(hbin)
+	b.Proof.encode(e)
+	e.uint32(uint32(len(b.Trans)))
+	for i := range b.Trans {
+		bin, err := b.Trans[i].MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("%v in transaction %d", err, i)
+		}
+		e.bytes(bin)
+	}
+	return e.Bytes(), nil
+}
+
+func (b *Block) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	var res Block
+	hbin := d.bytes()
+	if d.err == nil {
+		if err := res.Header.UnmarshalBinary(hbin); err != nil {
+			return err
+		}
+	}
+	res.Proof.decode(d)
+	if n := d.count(4); n > 0 {
+		res.Trans = make([]Transaction, n)
+		for i := range res.Trans {
+			tbin := d.bytes()
+			if d.err != nil {
+				break
+			}
+			if err := res.Trans[i].UnmarshalBinary(tbin); err != nil {
+				return fmt.Errorf("%v in transaction %d", err, i)
+			}
+		}
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*b = res
+	return nil
 }
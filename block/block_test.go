@@ -1,12 +1,19 @@
 package block
 
 import (
+	"bytes"
+	"crypto"
 	sign "crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding"
+	"encoding/json"
 	"github.com/kwonalbert/spacemint/pos"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -15,8 +22,12 @@ var oldB *Block
 var b *Block
 
 func TestChain(t *testing.T) {
-	chain.Add(oldB)
-	chain.Add(b)
+	if err := chain.Add(oldB); err != nil {
+		log.Fatal(err)
+	}
+	if err := chain.Add(b); err != nil {
+		log.Fatal(err)
+	}
 	b0, err := chain.Read(0)
 	if err != nil {
 		log.Fatal(err)
@@ -32,10 +43,1239 @@ func TestChain(t *testing.T) {
 }
 
 func TestMarshal(t *testing.T) {
-	bin, _ := b.MarshalBinary()
+	bin, err := b.MarshalBinary()
+	if err != nil {
+		log.Fatal(err)
+	}
 	bPrime := new(Block)
-	bPrime.UnmarshalBinary(bin)
+	if err := bPrime.UnmarshalBinary(bin); err != nil {
+		log.Fatal(err)
+	}
 	//log.Println("Marshal result:", b, bPrime)
+	again, _ := bPrime.MarshalBinary()
+	if !bytes.Equal(bin, again) || !bytes.Equal(b.ID(), bPrime.ID()) {
+		log.Fatal("Block did not round trip")
+	}
+	if bPrime.UnmarshalBinary(append(bin, 0)) == nil {
+		log.Fatal("Decoded a block with trailing bytes")
+	}
+	if bPrime.UnmarshalBinary(bin[:len(bin)-1]) == nil {
+		log.Fatal("Decoded a truncated block")
+	}
+
+	// json is only for people to read, but should still round trip
+	js, err := json.Marshal(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bJSON := new(Block)
+	if err := json.Unmarshal(js, bJSON); err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(b.ID(), bJSON.ID()) || !bytes.Equal(b.ProofHash, bJSON.Proof.Hash()) {
+		log.Fatal("Block did not round trip through json")
+	}
+
+	hbin, _ := b.Header.MarshalBinary()
+	h := new(Header)
+	if err := h.UnmarshalBinary(hbin); err != nil {
+		log.Fatal(err)
+	}
+	if !reflect.DeepEqual(*h, b.Header) || !bytes.Equal(h.ID(), b.ID()) {
+		log.Fatal("Header did not round trip:", h, b.Header)
+	}
+	if !bytes.Equal(b.ProofHash, b.Proof.Hash()) {
+		log.Fatal("Header does not commit to the proof")
+	}
+}
+
+func TestMerkle(t *testing.T) {
+	for n := 0; n < 10; n++ {
+		var leaves [][]byte
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, []byte{byte(i)})
+		}
+		root := MerkleRoot(leaves)
+		for i := range leaves {
+			proof := MerkleProof(leaves, i)
+			if !VerifyMerkle(root, leaves[i], i, n, proof) {
+				log.Fatal("Merkle proof failed:", n, i)
+			}
+			if VerifyMerkle(root, []byte{byte(n)}, i, n, proof) {
+				log.Fatal("Merkle proof verified a wrong leaf:", n, i)
+			}
+			if n > 1 && VerifyMerkle(root, leaves[i], i^1, n, proof) {
+				log.Fatal("Merkle proof verified at a wrong index:", n, i)
+			}
+		}
+	}
+	if bytes.Equal(MerkleRoot([][]byte{{1}, {2}, {3}}), MerkleRoot([][]byte{{1}, {2}, {3}, {3}})) {
+		log.Fatal("Duplicating the last leaf kept the root")
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	var _ encoding.BinaryUnmarshaler = new(Transaction)
+
+	ts := []Transaction{
+		{
+			Type: Payment,
+			In:   []In{{Tid: []byte{1, 2}, K: 1, Pk: []byte{16}, Sig: []byte{3}}},
+			Out:  []Out{{PkHash: []byte{4}, Coins: 5 * Coin / 2}, {PkHash: []byte{5}, Coins: 1}},
+		},
+		{
+			Type:   SpaceCommit,
+			Commit: &pos.Commitment{Pk: []byte{6}, Commit: []byte{7, 8}},
+		},
+		{
+			Type: Punishment,
+			Pk:   []byte{9},
+			M:    [2][]byte{{10}, {11}},
+			J:    -3,
+			Sig:  [2][]byte{{12}, {13}},
+		},
+		{
+			Type: Reward,
+			Out:  []Out{{PkHash: []byte{14}, Coins: 50 * Coin}},
+			J:    15,
+		},
+	}
+	for i := range ts {
+		bin, err := ts[i].MarshalBinary()
+		if err != nil {
+			log.Fatal(err)
+		}
+		tPrime := new(Transaction)
+		if err := tPrime.UnmarshalBinary(bin); err != nil {
+			log.Fatal(err)
+		}
+		if !reflect.DeepEqual(&ts[i], tPrime) {
+			log.Fatal("Transaction did not round trip:", ts[i], tPrime)
+		}
+		if !bytes.Equal(ts[i].Id(), tPrime.Id()) {
+			log.Fatal("Transaction id changed:", ts[i])
+		}
+		if err := tPrime.UnmarshalBinary(bin[:len(bin)-1]); err == nil {
+			log.Fatal("Truncated transaction decoded")
+		}
+	}
+
+	bad := Transaction{Type: Payment, Pk: []byte{1}}
+	if _, err := bad.MarshalBinary(); err == nil {
+		log.Fatal("Payment with punishment fields encoded")
+	}
+	bad = Transaction{Type: Reward, In: []In{{Tid: []byte{1}}}}
+	if _, err := bad.MarshalBinary(); err == nil {
+		log.Fatal("Reward with inputs encoded")
+	}
+}
+
+func TestAddress(t *testing.T) {
+	pk := []byte{KeyEd25519, 1, 2, 3}
+	main, test := &MainnetParams, &RegtestParams
+	addr := main.Address(pk)
+	if addr[0] != 'S' || addr == test.Address(pk) {
+		log.Fatal("Networks share addresses:", addr)
+	}
+	hash, err := main.DecodeAddress(addr)
+	if err != nil || !bytes.Equal(hash, PkHash(pk)) {
+		log.Fatal("Address did not round trip:", err)
+	}
+	if test.ValidateAddress(addr) == nil {
+		log.Fatal("Address valid on another network")
+	}
+	typo := []byte(addr)
+	if typo[5] == '2' {
+		typo[5] = '3'
+	} else {
+		typo[5] = '2'
+	}
+	if main.ValidateAddress(string(typo)) == nil {
+		log.Fatal("Mistyped address valid")
+	}
+	if main.ValidateAddress(addr[:len(addr)-1]) == nil {
+		log.Fatal("Short address valid")
+	}
+}
+
+func TestUTXO(t *testing.T) {
+	sk1, _ := sign.GenerateKey(elliptic.P256(), rand.Reader)
+	sk2, _ := sign.GenerateKey(elliptic.P256(), rand.Reader)
+	pk1, _ := EncodePublicKey(sk1.Public())
+	pk2, _ := EncodePublicKey(sk2.Public())
+	h1, h2 := PkHash(pk1), PkHash(pk2)
+
+	u := NewUTXOSet()
+	u.outs[outpoint{"fund", 0}] = Out{PkHash: h1, Coins: 10}
+
+	pay := func(signer *sign.PrivateKey, tid []byte, outs ...Out) Transaction {
+		tx := Transaction{
+			Type: Payment,
+			In:   []In{{Tid: tid, K: 0}},
+			Out:  outs,
+		}
+		tx.SignIn(0, signer)
+		return tx
+	}
+
+	tx1 := pay(sk1, []byte("fund"), Out{PkHash: h2, Coins: 6}, Out{PkHash: h1, Coins: 3})
+	fee, err := u.Validate(&tx1)
+	if err != nil || fee != 1 {
+		log.Fatal("Valid payment rejected:", fee, err)
+	}
+	// spends an output created earlier in the same block
+	tx2 := pay(sk2, tx1.Id(), Out{PkHash: h1, Coins: 6})
+	b1 := &Block{Header: Header{Id: 1}, Body: Body{Trans: []Transaction{tx1, tx2}}}
+	if err := u.Apply(b1); err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := u.Get([]byte("fund"), 0); ok {
+		log.Fatal("Spent output still in set")
+	}
+	if out, ok := u.Get(tx2.Id(), 0); !ok || out.Coins != 6 {
+		log.Fatal("Output missing from set")
+	}
+
+	bad := []Transaction{
+		pay(sk1, []byte("fund"), Out{PkHash: h2, Coins: 1}),    // double spend
+		pay(sk1, tx2.Id(), Out{PkHash: h2, Coins: 7}),          // overspend
+		pay(sk2, tx2.Id(), Out{PkHash: h2, Coins: 1}),          // wrong key
+		pay(sk1, tx2.Id(), Out{PkHash: h2, Coins: 0}),          // empty
+		pay(sk1, []byte("missing"), Out{PkHash: h2, Coins: 1}), // unknown
+	}
+	for i := range bad {
+		b2 := &Block{Header: Header{Id: 2}, Body: Body{Trans: []Transaction{pay(sk1, tx1.Id(), Out{PkHash: h2, Coins: 3}), bad[i]}}}
+		if err := u.Apply(b2); err == nil {
+			log.Fatal("Invalid payment accepted:", i)
+		}
+		if _, ok := u.Get(tx1.Id(), 1); !ok {
+			log.Fatal("Failed block changed the set")
+		}
+	}
+
+	if err := u.Rollback(b1); err != nil {
+		log.Fatal(err)
+	}
+	if len(u.outs) != 1 {
+		log.Fatal("Rollback left outputs behind:", u.outs)
+	}
+	if _, ok := u.Get([]byte("fund"), 0); !ok {
+		log.Fatal("Rollback did not restore the spent output")
+	}
+
+	if err := u.Apply(b1); err != nil {
+		log.Fatal(err)
+	}
+	u.Forget(b1.Id + 1)
+	if len(u.undo) != 0 || u.Rollback(b1) == nil {
+		log.Fatal("Forgotten block rolled back")
+	}
+}
+
+func TestReward(t *testing.T) {
+	sk, _ := sign.GenerateKey(elliptic.P256(), rand.Reader)
+	pk, _ := EncodePublicKey(sk.Public())
+	miner := []byte("miner")
+	mh := PkHash(miner)
+
+	u := NewUTXOSet()
+	u.Issuance = func(height int) uint64 { return 50 }
+	u.outs[outpoint{"fund", 0}] = Out{PkHash: PkHash(pk), Coins: 10}
+	payment := Transaction{
+		Type: Payment,
+		In:   []In{{Tid: []byte("fund"), K: 0}},
+		Out:  []Out{{PkHash: mh, Coins: 7}},
+	}
+	payment.SignIn(0, sk)
+	if fees, err := u.Fees([]Transaction{payment}); err != nil || fees != 3 {
+		log.Fatal("Wrong fees:", fees, err)
+	}
+	if _, ok := u.Get([]byte("fund"), 0); !ok {
+		log.Fatal("Fees changed the set")
+	}
+
+	reward := func(height int, outs ...Out) Transaction {
+		return Transaction{Type: Reward, Out: outs, J: height}
+	}
+	block := func(ts ...Transaction) *Block {
+		b := &Block{Header: Header{Id: 1}, Body: Body{Trans: ts}}
+		b.Proof.Commit.Pk = miner
+		return b
+	}
+	bad := []*Block{
+		block(reward(1, Out{PkHash: mh, Coins: 54}), payment),                              // too much
+		block(reward(1, Out{PkHash: PkHash(pk), Coins: 53}), payment),                      // not the miner
+		block(reward(2, Out{PkHash: mh, Coins: 53}), payment),                              // wrong height
+		block(payment, reward(1, Out{PkHash: mh, Coins: 53})),                              // not first
+		block(reward(1, Out{PkHash: mh, Coins: 50}), reward(1, Out{PkHash: mh, Coins: 1})), // twice
+		block(reward(1)), // empty
+	}
+	for i := range bad {
+		if err := u.Apply(bad[i]); err == nil {
+			log.Fatal("Invalid reward accepted:", i)
+		}
+		if len(u.outs) != 1 {
+			log.Fatal("Failed block changed the set")
+		}
+	}
+	good := block(reward(1, Out{PkHash: mh, Coins: 50}, Out{PkHash: mh, Coins: 3}), payment)
+	if err := u.Apply(good); err != nil {
+		log.Fatal(err)
+	}
+	if out, ok := u.Get(good.Trans[0].Id(), 1); !ok || out.Coins != 3 {
+		log.Fatal("Reward not paid")
+	}
+
+	// a chain pays its miners the network's issuance
+	fn := "reward.chain"
+	defer removeChain(fn)
+	chain, prover, commit, msk := newTestChain(fn)
+	defer chain.Close()
+	ts, err := chain.WithReward(commit.Pk, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := mine(chain, prover, commit, msk, ts)
+	if err := chain.Insert(b); err != nil {
+		log.Fatal(err)
+	}
+	if out, ok := chain.UTXO.Get(ts[0].Id(), 0); !ok || out.Coins != chain.Net.Reward {
+		log.Fatal("Miner not paid")
+	}
+	ts[0].Out[0].Coins++
+	ts[0].J++
+	if err := chain.Insert(mine(chain, prover, commit, msk, ts)); err == nil {
+		log.Fatal("Reward above the issuance accepted")
+	}
+}
+
+func TestMempool(t *testing.T) {
+	p1, c1, sk1 := newMiner()
+	p2, c2, sk2 := newMiner()
+	fn := "mempool.chain"
+	defer removeChain(fn)
+	chain := newGenesisChain(fn, c1, c2)
+	defer chain.Close()
+	pool := NewMempool(chain)
+
+	ts, err := pool.Template(c1.Pk, math.MaxInt32)
+	if err != nil || len(ts) != 1 {
+		log.Fatal("Template without a reward:", ts, err)
+	}
+	if err := chain.Insert(mine(chain, p1, c1, sk1, ts)); err != nil {
+		log.Fatal(err)
+	}
+	coinbase := ts[0].Id()
+	pay := func(fee uint64) Transaction {
+		tx := Transaction{
+			Type: Payment,
+			In:   []In{{Tid: coinbase, K: 0}},
+			Out:  []Out{{PkHash: PkHash(c2.Pk), Coins: 50*Coin - fee}},
+		}
+		tx.SignIn(0, sk1)
+		return tx
+	}
+
+	low, mid, high := pay(5*Coin), pay(10*Coin), pay(20*Coin)
+	if err := pool.Accept(&mid); err != nil {
+		log.Fatal(err)
+	}
+	if pool.Accept(&mid) == nil {
+		log.Fatal("Accepted a transaction twice")
+	}
+	if pool.Accept(&low) == nil {
+		log.Fatal("Accepted a double spend paying less")
+	}
+	if err := pool.Accept(&high); err != nil || pool.Has(mid.Id()) || pool.Len() != 1 {
+		log.Fatal("Double spend paying more did not replace:", err)
+	}
+	missing := pay(1)
+	missing.In[0].K = 1
+	if pool.Accept(&missing) == nil {
+		log.Fatal("Accepted a payment of a missing output")
+	}
+
+	ts, err = pool.Template(c1.Pk, math.MaxInt32)
+	if err != nil || len(ts) != 2 || ts[0].Out[0].Coins != chain.Net.BlockReward(2)+20*Coin {
+		log.Fatal("Bad template:", ts, err)
+	}
+	rsize := 4 + pool.Size() // a reward is smaller than the payment
+	if ts, _ := pool.Template(c1.Pk, rsize); len(ts) != 1 {
+		log.Fatal("Template does not fit its limit:", ts)
+	}
+
+	// the block taking the payment loses to a better one, which gives
+	// the payment back to the pool; quality doesn't depend on the
+	// transactions
+	lo := mine(chain, p1, c1, sk1, ts)
+	hi := mine(chain, p2, c2, sk2, nil)
+	if lo.Quality > hi.Quality {
+		ts, _ = pool.Template(c2.Pk, math.MaxInt32)
+		lo, hi = mine(chain, p2, c2, sk2, ts), mine(chain, p1, c1, sk1, nil)
+	}
+	if err := chain.Insert(lo); err != nil {
+		log.Fatal(err)
+	}
+	if pool.Len() != 0 {
+		log.Fatal("Block did not take its transactions from the pool")
+	}
+	if err := chain.Insert(hi); err != nil || !chain.OnMain(hi) {
+		log.Fatal("Better block did not win:", err)
+	}
+	if !pool.Has(high.Id()) || pool.Len() != 1 {
+		log.Fatal("Reorg did not give back the payment")
+	}
+
+	// a miner signing two blocks is punished; punishments go first, so
+	// they push payments out of a full pool
+	d := NewDetector()
+	ts, _ = pool.Template(c1.Pk, math.MaxInt32)
+	d.Observe(mine(chain, p1, c1, sk1, nil))
+	punish := d.Observe(mine(chain, p1, c1, sk1, ts))
+	if punish == nil {
+		log.Fatal("Two blocks at the same height not detected")
+	}
+	bin, _ := punish.MarshalBinary()
+	pool.MaxSize = len(bin)
+	if err := pool.Accept(punish); err != nil || pool.Has(high.Id()) || pool.Size() != len(bin) {
+		log.Fatal("Punishment did not replace the payment:", err)
+	}
+	if pool.Accept(&high) == nil {
+		log.Fatal("Accepted a payment into a full pool")
+	}
+	pool.MaxSize = 0
+	if pool.Accept(&high) == nil {
+		log.Fatal("Accepted a payment of a punished miner's reward")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	c1 := &pos.Commitment{Pk: []byte{1}, Commit: []byte{2}}
+	c2 := &pos.Commitment{Pk: []byte{1}, Commit: []byte{3}}
+	commit := func(cs ...*pos.Commitment) []Transaction {
+		var ts []Transaction
+		for _, c := range cs {
+			ts = append(ts, Transaction{Type: SpaceCommit, Commit: c})
+		}
+		return ts
+	}
+
+	r := NewRegistry(2)
+	blocks := []*Block{
+		{Header: Header{Id: 0}},
+		{Header: Header{Id: 1}, Body: Body{Trans: commit(c1)}},
+		{Header: Header{Id: 2}, Body: Body{Trans: commit(c2)}},
+	}
+	for _, b := range blocks {
+		if err := r.Apply(b); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := r.Apply(&Block{Header: Header{Id: 3}, Body: Body{Trans: commit(c1)}}); err == nil {
+		log.Fatal("Registered a commitment twice")
+	}
+	if len(r.ByPk([]byte{1})) != 2 {
+		log.Fatal("Wrong commitments by pk:", r.ByPk([]byte{1}))
+	}
+	if reg, ok := r.ById(CommitmentId(c2)); !ok || reg.Height != 2 {
+		log.Fatal("Commitment not found by id")
+	}
+
+	mined := &Block{Header: Header{Id: 3}, Body: Body{Proof: PoS{Commit: *c1}}}
+	if err := r.CheckProof(mined); err != nil {
+		log.Fatal(err)
+	}
+	mined.Proof.Commit = *c2
+	if err := r.CheckProof(mined); err == nil {
+		log.Fatal("Commitment used before the delay")
+	}
+
+	fn := "block.registry"
+	defer os.Remove(fn)
+	if err := r.Save(fn); err != nil {
+		log.Fatal(err)
+	}
+	loaded, err := LoadRegistry(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bin1, _ := r.MarshalBinary()
+	bin2, _ := loaded.MarshalBinary()
+	if !bytes.Equal(bin1, bin2) || loaded.Height() != 2 {
+		log.Fatal("Registry did not survive save and load")
+	}
+
+	if err := loaded.Rollback(blocks[2]); err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := loaded.ById(CommitmentId(c2)); ok || len(loaded.ByPk([]byte{1})) != 1 {
+		log.Fatal("Rollback kept the commitment")
+	}
+}
+
+func TestPunishment(t *testing.T) {
+	sk, _ := sign.GenerateKey(elliptic.P256(), rand.Reader)
+	pk, _ := EncodePublicKey(sk.Public())
+	c := &pos.Commitment{Pk: pk, Commit: []byte{1}}
+	genesis := &Block{Header: Header{Id: 0}, Body: Body{Trans: []Transaction{{Type: SpaceCommit, Commit: c}}}}
+	r := NewRegistry(0)
+	if err := r.Apply(genesis); err != nil {
+		log.Fatal(err)
+	}
+
+	prf := PoS{Commit: *c}
+	other := &pos.Commitment{Pk: []byte{2}, Commit: []byte{3}}
+	b1 := NewBlock(genesis, prf, nil, sk)
+	b2 := NewBlock(genesis, prf, []Transaction{{Type: SpaceCommit, Commit: other}}, sk)
+
+	d := NewDetector()
+	if d.Observe(b1) != nil || d.Observe(b1) != nil {
+		log.Fatal("Punished for one block")
+	}
+	punish := d.Observe(b2)
+	if punish == nil {
+		log.Fatal("Double signing not detected")
+	}
+	if err := ValidatePunishment(punish); err != nil {
+		log.Fatal(err)
+	}
+
+	forged := *punish
+	forged.Sig = [2][]byte{punish.Sig[0], punish.Sig[0]}
+	if ValidatePunishment(&forged) == nil {
+		log.Fatal("Forged evidence accepted")
+	}
+	forged = *punish
+	forged.M[1] = forged.M[0]
+	forged.Sig[1] = forged.Sig[0]
+	if ValidatePunishment(&forged) == nil {
+		log.Fatal("Punished for the same message")
+	}
+
+	b3 := &Block{Header: Header{Id: 1}, Body: Body{Trans: []Transaction{*punish}}}
+	if err := r.Apply(b3); err != nil {
+		log.Fatal(err)
+	}
+	if !r.Punished(pk) || r.CheckProof(b1) == nil {
+		log.Fatal("Offender not revoked")
+	}
+	if err := r.Rollback(b3); err != nil {
+		log.Fatal(err)
+	}
+	if r.Punished(pk) || r.CheckProof(b1) != nil {
+		log.Fatal("Rollback did not restore the commitment")
+	}
+
+	// the offender's unspent rewards are taken back
+	u := NewUTXOSet()
+	u.Issuance = func(int) uint64 { return 10 }
+	reward := Transaction{Type: Reward, Out: []Out{{PkHash: PkHash(pk), Coins: 10}}}
+	if err := u.Apply(&Block{Body: Body{Proof: prf, Trans: []Transaction{reward}}}); err != nil {
+		log.Fatal(err)
+	}
+	if err := u.Apply(b3); err != nil || len(u.ByPkHash(PkHash(pk))) != 0 {
+		log.Fatal("Rewards not taken back:", err)
+	}
+	if err := u.Rollback(b3); err != nil || len(u.ByPkHash(PkHash(pk))) != 1 {
+		log.Fatal("Rollback did not give back the rewards:", err)
+	}
+	forged = *punish
+	forged.Sig[1] = forged.Sig[0]
+	b4 := &Block{Header: Header{Id: 1}, Body: Body{Trans: []Transaction{forged}}}
+	if u.Apply(b4) == nil || len(u.ByPkHash(PkHash(pk))) != 1 {
+		log.Fatal("Forged punishment took rewards")
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	msg := []byte("spacemint")
+	for _, alg := range []int{KeyEd25519, KeyP256} {
+		sk, err := GenerateKey(alg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pk, err := EncodePublicKey(sk.Public())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if int(pk[0]) != alg {
+			log.Fatal("Wrong key algorithm:", pk[0], alg)
+		}
+		pub, err := DecodePublicKey(pk)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pk2, _ := EncodePublicKey(pub)
+		if !bytes.Equal(pk, pk2) {
+			log.Fatal("Public key did not round trip:", pk, pk2)
+		}
+
+		sig, err := Sign(sk, msg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !Verify(pk, msg, sig) {
+			log.Fatal("Signature did not verify")
+		}
+		if Verify(pk, []byte("other"), sig) {
+			log.Fatal("Signature verified for another message")
+		}
+	}
+	if _, err := DecodePublicKey([]byte{KeyP256, 1, 2}); err == nil {
+		log.Fatal("Decoded a bad public key")
+	}
+
+	sk, _ := GenerateKey(KeyEd25519)
+	pk, _ := EncodePublicKey(sk.Public())
+	prf := b.Proof
+	prf.Commit.Pk = pk
+	b1 := NewBlock(oldB, prf, nil, sk)
+	if err := VerifySignatures(&oldB.Header, &b1.Header, pk); err != nil {
+		log.Fatal(err)
+	}
+	b2 := NewBlock(b1, prf, nil, sk)
+	if err := VerifySignatures(&b1.Header, &b2.Header, pk); err != nil {
+		log.Fatal(err)
+	}
+	// b2's Ssig only holds if it follows b1
+	if VerifySignatures(&oldB.Header, &b2.Header, pk) == nil {
+		log.Fatal("Ssig verified against the wrong block")
+	}
+	b2.Id++
+	if VerifySignatures(&b1.Header, &b2.Header, pk) == nil {
+		log.Fatal("Tsig verified for a modified block")
+	}
+}
+
+// Mine the next block of chain with prover, which commits to sk's key
+func mine(chain *BlockChain, prover *pos.Prover, commit *pos.Commitment, sk crypto.Signer, ts []Transaction) *Block {
+	challenge, err := GenerateChallenge(chain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	v := pos.NewVerifier(commit.Pk, 4, chain.Params, commit.Commit)
+	hashes, parents, proofs, pProofs := prover.ProveSpace(v.SelectChallenges(challenge))
+	a := Answer{
+		Size:    4,
+		Hashes:  hashes,
+		Parents: parents,
+		Proofs:  proofs,
+		PProofs: pProofs,
+	}
+	prf := PoS{
+		Commit:    *commit,
+		Challenge: challenge,
+		Answer:    a,
+	}
+	last, err := chain.Read(chain.LastBlock)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return NewBlock(last, prf, ts, sk)
+}
+
+// A fresh miner: its prover and commitment, and the key it commits to
+func newMiner() (*pos.Prover, *pos.Commitment, *sign.PrivateKey) {
+	sk, _ := sign.GenerateKey(elliptic.P256(), rand.Reader)
+	pk, _ := EncodePublicKey(sk.Public())
+	prover := pos.NewProverStorage(pk, 4, "G", pos.NewMemStorage(), &pos.TestParams)
+	return prover, prover.Init(), sk
+}
+
+// Regtest chain with a genesis block that registers commits
+func newGenesisChain(fn string, commits ...*pos.Commitment) *BlockChain {
+	removeChain(fn)
+	p, _ := ChainPreset("regtest")
+	for _, commit := range commits {
+		p.Commits = append(p.Commits, *commit)
+	}
+	chain, err := OpenChain(fn, p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return chain
+}
+
+// Chain with a genesis block that registers a fresh miner
+func newTestChain(fn string) (*BlockChain, *pos.Prover, *pos.Commitment, *sign.PrivateKey) {
+	prover, commit, sk := newMiner()
+	return newGenesisChain(fn, commit), prover, commit, sk
+}
+
+func TestValidate(t *testing.T) {
+	fn := "validate.chain"
+	defer removeChain(fn)
+	chain, prover, commit, sk := newTestChain(fn)
+
+	good := mine(chain, prover, commit, sk, nil)
+	if err := ValidateBlock(chain, good); err != nil {
+		log.Fatal(err)
+	}
+
+	other, _ := sign.GenerateKey(elliptic.P256(), rand.Reader)
+	cases := map[int]*Block{
+		RulePrev:         mine(chain, prover, commit, sk, nil),
+		RuleHeight:       mine(chain, prover, commit, sk, nil),
+		RuleChallenge:    mine(chain, prover, commit, sk, nil),
+		RuleProof:        mine(chain, prover, commit, sk, nil),
+		RuleQuality:      mine(chain, prover, commit, sk, nil),
+		RuleSignature:    mine(chain, prover, commit, other, nil),
+		RuleTransactions: mine(chain, prover, commit, sk, []Transaction{{Type: Payment}}),
+	}
+	cases[RulePrev].Prev = []byte{1}
+	cases[RuleHeight].Id = 5
+	cases[RuleChallenge].Proof.Challenge = []byte{1}
+	cases[RuleProof].Proof.Answer.Hashes[0] = make([]byte, 32)
+	cases[RuleQuality].Quality += 0.5
+
+	for rule, b := range cases {
+		err := ValidateBlock(chain, b)
+		if e, ok := err.(*BlockError); !ok || e.Rule != rule {
+			log.Fatalf("Expected %s error, got %v", ruleNames[rule], err)
+		}
+	}
+
+	if err := chain.Add(good); err != nil {
+		log.Fatal(err)
+	}
+	if err := ValidateBlock(chain, mine(chain, prover, commit, sk, nil)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestOpenChain(t *testing.T) {
+	fn := "open.chain"
+	defer removeChain(fn)
+	chain, prover, commit, sk := newTestChain(fn)
+	for i := 0; i < 3; i++ {
+		if err := chain.Add(mine(chain, prover, commit, sk, nil)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	last, _ := chain.Read(chain.LastBlock)
+	chain.Close()
+
+	check := func(what string) *BlockChain {
+		chain, err := OpenBlockChain(fn)
+		if err != nil {
+			log.Fatal(what, ": ", err)
+		}
+		if chain.LastBlock != 3 || chain.Commits.Height() != 3 {
+			log.Fatal(what, ": reopened at ", chain.LastBlock)
+		}
+		b, err := chain.Read(3)
+		if err != nil || !reflect.DeepEqual(b, last) {
+			log.Fatal(what, ": last block differs: ", err)
+		}
+		return chain
+	}
+
+	// the reopened chain keeps growing
+	chain = check("reopen")
+	chain.Params = &pos.TestParams
+	next := mine(chain, prover, commit, sk, nil)
+	if err := ValidateBlock(chain, next); err != nil {
+		log.Fatal(err)
+	}
+	chain.Close()
+	check("reopen").Close()
+
+	// a torn write at the end is dropped
+	f, _ := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+	rec, _ := encodeRecord(next)
+	f.Write(rec[:len(rec)/2])
+	f.Close()
+	check("torn write").Close()
+	stat, _ := os.Stat(fn)
+	if end := chain.seekIndex[4]; stat.Size() != end {
+		log.Fatal("Torn write was not truncated:", stat.Size(), end)
+	}
+
+	// blocks missing from the index are recovered
+	os.Truncate(indexFile(fn), 12)
+	check("short index").Close()
+	os.Remove(indexFile(fn))
+	check("no index").Close()
+
+	// an up to date registry is loaded, and a stale one rebuilt
+	empty := NewRegistry(CommitDelay)
+	empty.height = 3
+	empty.Save(commitsFile(fn))
+	chain = check("saved registry")
+	if _, ok := chain.Commits.ById(CommitmentId(commit)); ok {
+		log.Fatal("Registry was replayed")
+	}
+	chain.Close()
+	empty.height = 2
+	empty.Save(commitsFile(fn))
+	chain = check("stale registry")
+	if _, ok := chain.Commits.ById(CommitmentId(commit)); !ok {
+		log.Fatal("Stale registry was loaded")
+	}
+	chain.Close()
+}
+
+func TestRepairChain(t *testing.T) {
+	fn := "repair.chain"
+	defer removeChain(fn)
+	chain, prover, commit, sk := newTestChain(fn)
+	for i := 0; i < 3; i++ {
+		if err := chain.Add(mine(chain, prover, commit, sk, nil)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	bad := chain.seekIndex[2] + recordHeader + 10
+	chain.Close()
+
+	rep, err := ScanChain(fn)
+	if err != nil || len(rep.Ends) != 4 || len(rep.Corrupt) != 0 {
+		log.Fatal("Scan of a good chain failed:", rep, err)
+	}
+
+	// flip a byte in block 2
+	f, _ := os.OpenFile(fn, os.O_RDWR, 0)
+	f.WriteAt([]byte{'X'}, bad)
+	f.Close()
+	if _, err := OpenBlockChain(fn); err == nil {
+		log.Fatal("Opened a corrupt chain")
+	}
+	rep, err = RepairChain(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(rep.Ends) != 2 || len(rep.Corrupt) != 1 || rep.Corrupt[0].Offset != chain.seekIndex[2] {
+		log.Fatal("Wrong scan report:", rep.Ends, rep.Corrupt)
+	}
+	chain, err = OpenBlockChain(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer chain.Close()
+	if chain.LastBlock != 1 {
+		log.Fatal("Repaired chain ends at", chain.LastBlock)
+	}
+}
+
+func TestFork(t *testing.T) {
+	p1, c1, sk1 := newMiner()
+	p2, c2, sk2 := newMiner()
+	defer removeChain("fork.chain")
+	defer removeChain("fork2.chain")
+	chain := newGenesisChain("fork.chain", c1, c2)
+	other := newGenesisChain("fork2.chain", c1, c2)
+	defer chain.Close()
+	defer other.Close()
+
+	var reorgs []*Reorg
+	chain.OnReorg(func(r *Reorg) { reorgs = append(reorgs, r) })
+
+	// two miners win the same round; the better block wins
+	a := mine(chain, p1, c1, sk1, nil)
+	c := mine(chain, p2, c2, sk2, nil)
+	lo, hi := a, c
+	if lo.Quality > hi.Quality {
+		lo, hi = hi, lo
+	}
+	for _, b := range []*Block{lo, hi, lo} {
+		if err := chain.Insert(b); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !chain.OnMain(hi) || chain.OnMain(lo) || !chain.Contains(lo.ID()) || chain.LastBlock != 1 {
+		log.Fatal("Better block did not win")
+	}
+	if len(reorgs) != 1 || reorgs[0].Fork != 0 ||
+		!reflect.DeepEqual(reorgs[0].Removed, []*Block{lo}) || reorgs[0].Added[0] != hi {
+		log.Fatal("Wrong reorg events:", reorgs)
+	}
+
+	// the lost block's branch takes over once it is better
+	if err := other.Add(lo); err != nil {
+		log.Fatal(err)
+	}
+	quality := lo.Quality
+	for i := 0; i < 5; i++ {
+		b := mine(other, p1, c1, sk1, nil)
+		if err := other.Add(b); err != nil {
+			log.Fatal(err)
+		}
+		if err := chain.Insert(b); err != nil {
+			log.Fatal(err)
+		}
+		quality += b.Quality
+		if chain.OnMain(b) != (quality > hi.Quality) {
+			log.Fatal("Wrong branch chosen at block", b.Id)
+		}
+	}
+	if chain.LastBlock != 6 || chain.UTXO == nil || chain.Commits.Height() != 6 {
+		log.Fatal("Chain did not switch to the longer branch")
+	}
+
+	// a shorter branch loses, however good its blocks
+	short := []*Block{{Header: Header{Id: 1, Quality: 100}}}
+	if better, err := chain.better(short, 0); err != nil || better {
+		log.Fatal("Shorter branch won:", err)
+	}
+	long := short
+	for i := 2; i <= 6; i++ {
+		long = append(long, &Block{Header: Header{Id: i}})
+	}
+	if better, _ := chain.better(long, 0); !better {
+		log.Fatal("Branch as long and better lost")
+	}
+
+	// a bad block never makes it onto the main chain
+	bad := mine(other, p1, c1, sk1, nil)
+	bad.Sig.Ssig = bad.Sig.Tsig
+	if err := chain.Insert(bad); err == nil || chain.LastBlock != 6 {
+		log.Fatal("Inserted a badly signed block")
+	}
+	if err := chain.Insert(&Block{Header: Header{Id: 3, Prev: []byte{1}}}); err == nil {
+		log.Fatal("Inserted a block with an unknown parent")
+	}
+
+	// a fork block with a forged answer is refused before it can touch
+	// the chain file
+	genesis, _ := chain.Read(0)
+	forged := &Block{Header: Header{Prev: genesis.ID(), Id: 1}}
+	forged.Proof.Answer = Answer{Size: 40, Hashes: [][]byte{{0xff}}}
+	forged.Quality = Quality(&forged.Proof.Answer)
+	added := 0
+	chain.OnBlock(func(*Block) { added++ })
+	if err := chain.Insert(forged); err == nil || chain.Contains(forged.ID()) {
+		log.Fatal("Inserted a fork block with a forged answer")
+	}
+	if added != 0 || chain.LastBlock != 6 {
+		log.Fatal("Forged fork block changed the chain")
+	}
+
+	// a miner extending both branches is caught where they meet, even
+	// when its blocks are seen at different heights
+	defer removeChain("fork3.chain")
+	third := newGenesisChain("fork3.chain", c1, c2)
+	defer third.Close()
+	if err := third.Add(hi); err != nil {
+		log.Fatal(err)
+	}
+	y := mine(third, p1, c1, sk1, nil)
+	m3, _ := chain.Read(3)
+	d := NewDetector()
+	if d.Observe(y) != nil || d.Observe(m3) != nil {
+		log.Fatal("Punished without looking at ancestors")
+	}
+	d = NewDetector()
+	d.Chain = chain
+	if d.Observe(y) != nil {
+		log.Fatal("Punished for one block")
+	}
+	punish := d.Observe(m3)
+	if punish == nil || punish.J != 2 || ValidatePunishment(punish) != nil {
+		log.Fatal("Miner of two branches not caught:", punish)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	fn := "lookup.chain"
+	defer removeChain(fn)
+	chain, prover, commit, sk := newTestChain(fn)
+	var blocks []*Block
+	for i := 0; i < 4; i++ {
+		b := mine(chain, prover, commit, sk, nil)
+		if err := chain.Add(b); err != nil {
+			log.Fatal(err)
+		}
+		blocks = append(blocks, b)
+	}
+	chain.Close()
+	chain, err := OpenBlockChain(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer chain.Close()
+
+	for _, b := range blocks {
+		id, err := chain.IdAt(b.Id)
+		if err != nil || !bytes.Equal(id, b.ID()) {
+			log.Fatal("Wrong id at", b.Id)
+		}
+		if i, ok := chain.Height(b.ID()); !ok || i != b.Id {
+			log.Fatal("Wrong height for block", b.Id, i)
+		}
+		if !chain.Contains(b.ID()) {
+			log.Fatal("Chain does not contain block", b.Id)
+		}
+		read, err := chain.ReadId(b.ID())
+		if err != nil || !reflect.DeepEqual(read, b) {
+			log.Fatal("Read wrong block by id:", b.Id, err)
+		}
+	}
+	if chain.Contains([]byte{1}) {
+		log.Fatal("Chain contains an unknown block")
+	}
+	if _, err := chain.IdAt(5); err == nil {
+		log.Fatal("Got an id past the last block")
+	}
+
+	var ids []int
+	collect := func(b *Block) bool {
+		ids = append(ids, b.Id)
+		return len(ids) < 3
+	}
+	if err := chain.Range(2, 10, collect); err != nil {
+		log.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{2, 3, 4}) {
+		log.Fatal("Wrong range:", ids)
+	}
+	ids = nil
+	if err := chain.Reverse(collect); err != nil {
+		log.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{4, 3, 2}) {
+		log.Fatal("Wrong reverse range:", ids)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	fn := "prune.chain"
+	defer removeChain(fn)
+	chain, prover, commit, sk := newTestChain(fn)
+	chain.PruneDepth = 1 // raised to ReorgWindow
+	for i := 0; i < ReorgWindow+3; i++ {
+		ts, err := chain.WithReward(commit.Pk, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := chain.Insert(mine(chain, prover, commit, sk, ts)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	before, _ := os.Stat(fn)
+	balance := len(chain.UTXO.ByPkHash(PkHash(commit.Pk)))
+	if err := chain.PruneAnswers(); err != nil {
+		log.Fatal(err)
+	}
+	after, _ := os.Stat(fn)
+	if chain.PrunedTo() != 3 || chain.Archival() || after.Size() >= before.Size() {
+		log.Fatal("Nothing pruned:", chain.PrunedTo(), before.Size(), after.Size())
+	}
+	for i := 1; i <= 4; i++ {
+		b, err := chain.Read(i)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if b.Pruned() != (i <= 3) || len(b.Proof.Commit.Pk) == 0 {
+			log.Fatal("Wrong answers pruned at block", i)
+		}
+	}
+	if _, err := chain.Headers(1, 5); err == nil {
+		log.Fatal("Served pruned proofs")
+	}
+	if _, err := chain.Headers(4, 5); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := ExportChain(fn, chain.Net, ioutil.Discard); err == nil {
+		log.Fatal("Exported pruned proofs")
+	}
+	if err := chain.Insert(mine(chain, prover, commit, sk, nil)); err != nil {
+		log.Fatal(err)
+	}
+	chain.Close()
+
+	// the pruned chain replays, and keeps growing
+	chain, err := OpenChain(fn, chain.Net)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer chain.Close()
+	if chain.PrunedTo() != 3 || chain.LastBlock != ReorgWindow+4 ||
+		len(chain.UTXO.ByPkHash(PkHash(commit.Pk))) != balance {
+		log.Fatal("Pruned chain did not reopen:", chain.PrunedTo(), chain.LastBlock)
+	}
+	if err := chain.Insert(mine(chain, prover, commit, sk, nil)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	fn, fn2 := "export.chain", "import.chain"
+	defer removeChain(fn)
+	defer removeChain(fn2)
+	chain, prover, commit, sk := newTestChain(fn)
+	defer chain.Close()
+	for i := 0; i < 4; i++ {
+		ts, err := chain.WithReward(commit.Pk, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := chain.Insert(mine(chain, prover, commit, sk, ts)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var exp bytes.Buffer
+	n, err := ExportChain(fn, chain.Net, &exp)
+	if err != nil || n != chain.LastBlock+1 {
+		log.Fatal("Export failed:", n, err)
+	}
+	var lines bytes.Buffer
+	if n, err := ExportJSON(fn, &lines); err != nil || n != chain.LastBlock+1 ||
+		bytes.Count(lines.Bytes(), []byte("\n")) != n {
+		log.Fatal("JSON export failed:", n, err)
+	}
+
+	// an export cut short imports up to where it stops, and the
+	// whole one resumes from there
+	other := newGenesisChain(fn2, commit)
+	defer other.Close()
+	if _, err := ImportChain(other, bytes.NewReader(exp.Bytes()[:exp.Len()-10])); err == nil {
+		log.Fatal("Imported a partial block")
+	}
+	if other.LastBlock != 3 {
+		log.Fatal("Partial import stopped at block", other.LastBlock)
+	}
+	n, err = ImportChain(other, bytes.NewReader(exp.Bytes()))
+	if err != nil || n != 1 || other.LastBlock != chain.LastBlock {
+		log.Fatal("Import did not resume:", n, err)
+	}
+	for i := 0; i <= chain.LastBlock; i++ {
+		if other.hashes[i] != chain.hashes[i] {
+			log.Fatal("Imported chain differs at block", i)
+		}
+	}
+	if !reflect.DeepEqual(other.UTXO.ByPkHash(PkHash(commit.Pk)), chain.UTXO.ByPkHash(PkHash(commit.Pk))) {
+		log.Fatal("Imported chain has different coins")
+	}
+
+	bad := append([]byte(nil), exp.Bytes()...)
+	bad[len(bad)-20] ^= 1
+	if _, err := ImportChain(other, bytes.NewReader(bad)); err == nil {
+		log.Fatal("Imported a tampered block")
+	}
+	neg, _ := chain.Read(0)
+	neg.Id = -1
+	rec, err := encodeRecord(neg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	head := len(exportMagic) + 1 + 4 + len(chain.Net.Name)
+	bad = append(append([]byte(nil), exp.Bytes()[:head]...), rec...)
+	if _, err := ImportChain(other, bytes.NewReader(bad)); err == nil {
+		log.Fatal("Imported a block with a negative id")
+	}
+	mainnet, _ := ChainPreset("mainnet")
+	if _, err := ExportChain(fn, mainnet, ioutil.Discard); err == nil {
+		log.Fatal("Exported a chain as another network's")
+	}
+}
+
+func TestLight(t *testing.T) {
+	fn := "light.chain"
+	defer removeChain(fn)
+	chain, prover, commit, sk := newTestChain(fn)
+	defer chain.Close()
+	other := &pos.Commitment{Pk: []byte{2}, Commit: []byte{3}}
+	tx := Transaction{Type: SpaceCommit, Commit: other}
+	for i := 0; i < 4; i++ {
+		var ts []Transaction
+		if i == 1 {
+			ts = []Transaction{{Type: SpaceCommit, Commit: &pos.Commitment{Pk: []byte{4}, Commit: []byte{5}}}, tx}
+		}
+		if err := chain.Add(mine(chain, prover, commit, sk, ts)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	lc := NewLightChain(chain.Net)
+	phs, err := chain.Headers(0, chain.LastBlock)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bad := phs[3]
+	bad.Proof.Answer.Hashes = append([][]byte(nil), bad.Proof.Answer.Hashes...)
+	bad.Proof.Answer.Hashes[0] = make([]byte, 32)
+	if n, err := lc.Sync([]ProvenHeader{phs[1], phs[2], bad}); n != 2 {
+		log.Fatal("Synced a header with a bad proof:", n, err)
+	} else if e, ok := err.(*BlockError); !ok || e.Rule != RuleProof {
+		log.Fatal("Expected proof error, got", err)
+	}
+	if n, err := lc.Sync(phs); err != nil || n != 2 || lc.LastBlock != 4 {
+		log.Fatal("Sync failed:", n, err)
+	}
+
+	p, err := chain.ProveTx(tx.Id())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf, err := lc.VerifyTx(p); err != nil || conf != 3 {
+		log.Fatal("Transaction did not verify:", conf, err)
+	}
+	p.Tx.Commit = &pos.Commitment{Pk: []byte{2}, Commit: []byte{4}}
+	if _, err := lc.VerifyTx(p); err == nil {
+		log.Fatal("Verified a transaction not in the block")
+	}
+}
+
+func TestGenesis(t *testing.T) {
+	prover, commit, sk := newMiner()
+	p, err := ChainPreset("regtest")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range []string{"mainnet", "regtest"} {
+		if preset, _ := ChainPreset(name); len(preset.Genesis().Trans) == 0 {
+			log.Fatal("No commitments in the genesis of", name)
+		}
+	}
+	p.Commits = []pos.Commitment{*commit}
+	if !bytes.Equal(p.Genesis().ID(), p.Genesis().ID()) {
+		log.Fatal("Genesis is not deterministic")
+	}
+	other := *p
+	other.Name = "other"
+	if bytes.Equal(p.Genesis().ID(), other.Genesis().ID()) {
+		log.Fatal("Networks share a genesis block")
+	}
+
+	fn := "genesis.chain"
+	defer removeChain(fn)
+	removeChain(fn)
+	chain, err := OpenChain(fn, p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if chain.LastBlock != 0 || !chain.OnMain(p.Genesis()) || chain.Dist != p.Dist {
+		log.Fatal("Chain did not start with genesis")
+	}
+	b := mine(chain, prover, commit, sk, nil)
+	if err := ValidateBlock(chain, b); err != nil {
+		log.Fatal(err)
+	}
+	chain.MaxSize = 100
+	if e, ok := ValidateBlock(chain, b).(*BlockError); !ok || e.Rule != RuleSize {
+		log.Fatal("Expected size error, got", e)
+	}
+	chain.Close()
+
+	if _, err := OpenChain(fn, &other); err == nil {
+		log.Fatal("Opened a chain of another network")
+	}
+	chain, err = OpenChain(fn, p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chain.Close()
+
+	if p.BlockReward(0) != 50*Coin || p.BlockReward(p.HalvingInterval) != 25*Coin ||
+		p.BlockReward(64*p.HalvingInterval) != 0 {
+		log.Fatal("Wrong reward schedule:", p.BlockReward(0), p.BlockReward(p.HalvingInterval))
+	}
+}
+
+func removeChain(fn string) {
+	os.Remove(fn)
+	os.Remove(indexFile(fn))
+	os.Remove(commitsFile(fn))
 }
 
 func TestMain(m *testing.M) {
@@ -43,8 +1283,7 @@ func TestMain(m *testing.M) {
 	chain = NewBlockChain("block.chain")
 
 	pk := []byte{1}
-	pos.Setup(pk, 4, "../pos/graph")
-	prover := pos.NewProver(pk, 4, "../pos/graph")
+	prover := pos.NewProverStorage(pk, 4, "G", pos.NewMemStorage(), &pos.TestParams)
 	commit := prover.Init()
 	pos := PoS{
 		Commit:    *commit,
@@ -54,18 +1293,14 @@ func TestMain(m *testing.M) {
 			Hashes: [][]byte{[]byte{3}, []byte{4}},
 			Proofs: nil,
 		},
-		Quality: 1.3,
 	}
 
-	ts := make([]Transaction, 2)
+	var ts []Transaction
 
 	sk, _ := sign.GenerateKey(elliptic.P256(), rand.Reader)
-	oldB = &Block{
-		Id:    0,
-		Hash:  Hash{},
-		Trans: make([]Transaction, 3),
-		Sig:   Signature{},
-	}
+	p := RegtestParams
+	p.Commits = append(p.Commits, *commit)
+	oldB = p.Genesis()
 	b = NewBlock(oldB, pos, ts, sk)
 	os.Exit(m.Run())
 }
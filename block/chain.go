@@ -1,75 +1,479 @@
 package block
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+
+	"github.com/kwonalbert/spacemint/pos"
 )
 
 // Defines and implements block chain
 
+// The chain is kept in three files: fn holds the blocks back to back in
+// records (see record.go), fn.index the offset at which each record
+// ends, and fn.commits the commitment registry as of the last block.
+// Only fn is authoritative; the others are rebuilt from it when they
+// are missing or stale, so failing to write them doesn't fail Add.
+
 type BlockChain struct {
-	chain           *os.File          // block chain (in a single file)
-	//probably should write this out to disk too?
-	seekIndex       map[int]int64     // maps nth block to a seek index
-	LastBlock       int               // last block that was added
+	fn        string
+	chain     *os.File       // block chain (in a single file)
+	index     *os.File       // end offset of each block, see indexFile
+	seekIndex map[int]int64  // maps nth block to a seek index
+	hashes    []string       // id of each block
+	heights   map[string]int // height of each block by id
+	LastBlock int            // last block that was added
+	Dist      int            // how far to look back for challenge
+	Params    *pos.Params    // proof of space parameters
+	MaxSize   int            // largest encoded block; 0 for no limit
+	Net       *ChainParams   // network of the chain, if opened with one
+
+	PruneDepth int // blocks that keep their answers; 0 for all, see PruneAnswers
+
+	UTXO    *UTXOSet  // unspent outputs as of LastBlock
+	Commits *Registry // space commitments as of LastBlock
+
+	pruned     int               // last block whose answer was pruned
+	side       map[string]*Block // blocks off the main chain, see Insert
+	hooks      []func(*Reorg)
+	blockHooks []func(*Block)
 }
 
+// return: the name of the index file kept next to chain fn
+func indexFile(fn string) string {
+	return fn + ".index"
+}
+
+// return: the name of the registry file kept next to chain fn
+func commitsFile(fn string) string {
+	return fn + ".commits"
+}
+
+// Create an empty chain in fn, replacing any chain already there
 func NewBlockChain(fn string) *BlockChain {
+	os.Remove(indexFile(fn))
+	os.Remove(commitsFile(fn))
 	f, err := os.Create(fn)
 	if err != nil {
 		panic(err)
 	}
+	bc, err := openChain(fn, f, nil)
+	if err != nil {
+		panic(err)
+	}
+	return bc
+}
 
+// Open the chain in fn, creating it if it does not exist. Blocks past
+// the persisted index are recovered, and a block that was only partly
+// written, e.g. because of a crash during Add, is truncated away.
+func OpenBlockChain(fn string) (*BlockChain, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := openChain(fn, f, nil)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+// Open the chain of network p in fn, like OpenBlockChain. An empty
+// chain starts with p's genesis block, and a chain that starts with
+// another genesis block is refused.
+func OpenChain(fn string, p *ChainParams) (*BlockChain, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := openChain(fn, f, p)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+// Open the chain in f; with network p if it isn't nil, and with
+// the defaults of the prototype otherwise
+func openChain(fn string, f *os.File, p *ChainParams) (*BlockChain, error) {
 	bc := BlockChain{
-		chain: f,
-		seekIndex: make(map[int]int64),
+		fn:        fn,
+		chain:     f,
+		seekIndex: map[int]int64{0: 0},
+		heights:   make(map[string]int),
 		LastBlock: -1,
+		Dist:      1,
+		Params:    &pos.DefaultParams,
+
+		UTXO:    NewUTXOSet(),
+		Commits: NewRegistry(CommitDelay),
+
+		side: make(map[string]*Block),
+	}
+	if p != nil {
+		bc.Dist = p.Dist
+		bc.Params = &p.PoS
+		bc.MaxSize = p.MaxBlockSize
+		bc.Net = p
+		bc.Commits = NewRegistry(p.CommitDelay)
+		bc.UTXO.Issuance = p.BlockReward
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ends, err := loadIndex(indexFile(fn), stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	for _, end := range ends {
+		bc.LastBlock++
+		bc.seekIndex[bc.LastBlock+1] = end
+	}
+	indexed := len(ends)
+
+	// recover whole blocks written after the index, and drop a torn one
+	end := bc.seekIndex[bc.LastBlock+1]
+	rep := scanRecords(f, end, stat.Size())
+	if len(rep.Corrupt) > 0 && !rep.Torn() {
+		return nil, fmt.Errorf("block: %s: %v; run RepairChain to drop it and what follows",
+			fn, rep.Corrupt[0])
+	}
+	for _, next := range rep.Ends {
+		bc.LastBlock++
+		bc.seekIndex[bc.LastBlock+1] = next
+	}
+	end = bc.seekIndex[bc.LastBlock+1]
+	if end < stat.Size() {
+		if err := f.Truncate(end); err != nil {
+			return nil, err
+		}
+	}
+
+	// the UTXO set is rebuilt from the blocks, and so is the registry
+	// unless its file is as of the last block
+	replay := true
+	if r, err := LoadRegistry(commitsFile(fn)); err == nil &&
+		r.Height() == bc.LastBlock && r.delay == bc.Commits.delay {
+		bc.Commits = r
+		replay = false
+	}
+	for i := 0; i <= bc.LastBlock; i++ {
+		b, err := bc.Read(i)
+		if err != nil {
+			return nil, err
+		}
+		if b.Id != i {
+			return nil, fmt.Errorf("block: block %d of %s has id %d", i, fn, b.Id)
+		}
+		hash := b.ID()
+		bc.hashes = append(bc.hashes, string(hash))
+		bc.heights[string(hash)] = i
+		if b.Pruned() {
+			bc.pruned = i
+		}
+		if err := bc.UTXO.Apply(b); err != nil {
+			return nil, fmt.Errorf("block: replaying block %d: %v", i, err)
+		}
+		bc.UTXO.Forget(i - ReorgWindow)
+		if !replay {
+			continue
+		}
+		if err := bc.Commits.Apply(b); err != nil {
+			return nil, fmt.Errorf("block: replaying block %d: %v", i, err)
+		}
+	}
+
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := bc.openIndex(indexed); err != nil {
+		return nil, err
+	}
+	if p != nil {
+		if err := bc.checkGenesis(); err != nil {
+			bc.index.Close()
+			return nil, err
+		}
+	}
+	if replay && bc.LastBlock >= 0 {
+		bc.saveCommits()
+	}
+	return &bc, nil
+}
+
+// Start an empty chain with the genesis block of its network, or check
+// that the chain starts with it
+func (bc *BlockChain) checkGenesis() error {
+	genesis := bc.Net.Genesis()
+	if bc.LastBlock < 0 {
+		return bc.Add(genesis)
+	}
+	if bc.hashes[0] != string(genesis.ID()) {
+		return fmt.Errorf("block: %s is not a %s chain", bc.fn, bc.Net.Name)
+	}
+	return nil
+}
+
+// Read the block end offsets in index file fn, keeping the entries
+// that are consistent with a chain of size bytes
+func loadIndex(fn string, size int64) ([]int64, error) {
+	bin, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ends []int64
+	prev := int64(0)
+	for len(bin) >= 8 {
+		end := int64(binary.BigEndian.Uint64(bin))
+		if end <= prev || end > size {
+			break
+		}
+		ends = append(ends, end)
+		prev = end
+		bin = bin[8:]
 	}
-	return &bc
+	return ends, nil
+}
+
+// Write the block end offsets to index file fn
+func writeIndex(fn string, ends []int64) error {
+	bin := make([]byte, 8*len(ends))
+	for i, end := range ends {
+		binary.BigEndian.PutUint64(bin[8*i:], uint64(end))
+	}
+	return ioutil.WriteFile(fn, bin, 0666)
+}
+
+// Open the index file for appending; it is rewritten unless it already
+// holds exactly the first indexed blocks
+func (bc *BlockChain) openIndex(indexed int) error {
+	fn := indexFile(bc.fn)
+	stat, err := os.Stat(fn)
+	if err != nil || indexed != bc.LastBlock+1 || stat.Size() != int64(indexed)*8 {
+		ends := make([]int64, bc.LastBlock+1)
+		for i := range ends {
+			ends[i] = bc.seekIndex[i+1]
+		}
+		if err := writeIndex(fn, ends); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	bc.index = f
+	return nil
 }
 
 // Add a block to end of chain
+// The block's transactions are applied to the UTXO set and registry,
+// and the block is rejected if they don't apply. The block is synced
+// to disk before Add returns. The OnBlock hooks run once the block is
+// on the chain.
 func (bc *BlockChain) Add(b *Block) error {
-	bin, err := b.MarshalBinary()
+	bin, err := encodeRecord(b)
 	if err != nil {
 		return err
 	}
+	hash := b.ID()
 
+	if err := bc.apply(b); err != nil {
+		return err
+	}
+
+	start := bc.seekIndex[bc.LastBlock+1]
 	n, err := bc.chain.Write(bin)
+	if err == nil && n != len(bin) {
+		err = errors.New("Couldn't write the whole block to chain.")
+	}
+	if err == nil {
+		err = bc.chain.Sync()
+	}
 	if err != nil {
+		// leave the chain as it was, so later blocks don't end up
+		// after a partial one
+		bc.chain.Truncate(start)
+		bc.chain.Seek(start, io.SeekStart)
+		bc.rollback(b)
 		return err
-	} else if n != len(bin) {
-		return errors.New("Couldn't write the whole block to chain.")
 	}
 
 	bc.LastBlock++
-	if bc.LastBlock == 0 {
-		bc.seekIndex[bc.LastBlock] = 0
+	bc.seekIndex[bc.LastBlock+1] = start + int64(len(bin))
+	bc.hashes = append(bc.hashes, string(hash))
+	bc.heights[string(hash)] = bc.LastBlock
+	for _, f := range bc.blockHooks {
+		f(b)
 	}
-	bc.seekIndex[bc.LastBlock+1] = bc.seekIndex[bc.LastBlock] + int64(len(bin))
+
+	// b is on the chain now; the index and registry files can be
+	// rebuilt, so they aren't synced and errors writing them are
+	// only repaired
+	bc.appendIndex()
+	bc.saveCommits()
 	return nil
 }
 
+// Append the end of the last block to the index file, rewriting the
+// file if that fails; if that fails too, the index is rebuilt on open
+func (bc *BlockChain) appendIndex() {
+	var end [8]byte
+	binary.BigEndian.PutUint64(end[:], uint64(bc.seekIndex[bc.LastBlock+1]))
+	if _, err := bc.index.Write(end[:]); err == nil {
+		return
+	}
+	bc.index.Close()
+	if err := bc.openIndex(0); err != nil {
+		os.Remove(indexFile(bc.fn))
+	}
+}
+
+// Write the registry to its file; if that fails, the file is removed,
+// so a stale registry isn't loaded on open
+func (bc *BlockChain) saveCommits() {
+	fn := commitsFile(bc.fn)
+	if err := bc.Commits.Save(fn); err != nil {
+		os.Remove(fn)
+	}
+}
+
+// return: ts for the block after LastBlock, after a reward that pays
+//         pk everything the block may claim; ts if there is nothing
+//         to claim
+func (bc *BlockChain) WithReward(pk []byte, ts []Transaction) ([]Transaction, error) {
+	height := bc.LastBlock + 1
+	claim, err := bc.UTXO.Fees(ts)
+	if err != nil {
+		return nil, err
+	}
+	if bc.UTXO.Issuance != nil {
+		claim += bc.UTXO.Issuance(height)
+	}
+	if claim == 0 {
+		return ts, nil
+	}
+	reward := Transaction{
+		Type: Reward,
+		Out:  []Out{{PkHash: PkHash(pk), Coins: claim}},
+		J:    height,
+	}
+	return append([]Transaction{reward}, ts...), nil
+}
+
+// Apply b to the UTXO set and registry, or neither
+func (bc *BlockChain) apply(b *Block) error {
+	if err := bc.UTXO.Apply(b); err != nil {
+		return err
+	}
+	if err := bc.Commits.Apply(b); err != nil {
+		bc.UTXO.Rollback(b)
+		return err
+	}
+	return nil
+}
+
+func (bc *BlockChain) rollback(b *Block) {
+	bc.Commits.Rollback(b)
+	bc.UTXO.Rollback(b)
+}
+
 // Find and return the ith block
 func (bc *BlockChain) Read(i int) (*Block, error) {
-	idx := bc.seekIndex[i]
-	next, ok := bc.seekIndex[i+1]
-	if !ok { //last block
-		stat, err := bc.chain.Stat()
+	if i < 0 || i > bc.LastBlock {
+		return nil, fmt.Errorf("block: no block %d in chain", i)
+	}
+	b, _, err := readRecord(bc.chain, bc.seekIndex[i], bc.seekIndex[i+1])
+	if err != nil {
+		return nil, fmt.Errorf("block: reading block %d: %v", i, err)
+	}
+	return b, nil
+}
+
+// return: the id of the ith block
+func (bc *BlockChain) IdAt(i int) ([]byte, error) {
+	if i < 0 || i > bc.LastBlock {
+		return nil, fmt.Errorf("block: no block %d in chain", i)
+	}
+	return []byte(bc.hashes[i]), nil
+}
+
+// return: the height of the block with id, if it is on the main chain
+func (bc *BlockChain) Height(id []byte) (int, bool) {
+	i, ok := bc.heights[string(id)]
+	return i, ok
+}
+
+// return: whether the chain holds the block with id, either on the
+//         main chain or on a fork
+func (bc *BlockChain) Contains(id []byte) bool {
+	if _, ok := bc.heights[string(id)]; ok {
+		return true
+	}
+	_, ok := bc.side[string(id)]
+	return ok
+}
+
+// Find and return the block with id, from the main chain or a fork
+func (bc *BlockChain) ReadId(id []byte) (*Block, error) {
+	if i, ok := bc.heights[string(id)]; ok {
+		return bc.Read(i)
+	}
+	if b, ok := bc.side[string(id)]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("block: no block %x in chain", id)
+}
+
+// Call f on the blocks from height from up to and including to, in
+// order, until f returns false
+func (bc *BlockChain) Range(from, to int, f func(*Block) bool) error {
+	if from < 0 {
+		from = 0
+	}
+	for i := from; i <= to && i <= bc.LastBlock; i++ {
+		b, err := bc.Read(i)
+		if err != nil {
+			return err
+		}
+		if !f(b) {
+			break
+		}
+	}
+	return nil
+}
+
+// Call f on the blocks from the last one back to the genesis block,
+// until f returns false
+func (bc *BlockChain) Reverse(f func(*Block) bool) error {
+	for i := bc.LastBlock; i >= 0; i-- {
+		b, err := bc.Read(i)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		if !f(b) {
+			break
 		}
-		next = stat.Size()
 	}
+	return nil
+}
 
-	bin := make([]byte, next-idx)
-	n, err := bc.chain.ReadAt(bin, idx)
-	if err != nil {
-		return nil, err
-	} else if n != len(bin) {
-		return nil, errors.New("Couldn't read the whole block from chain.")
+// Close the files backing the chain
+func (bc *BlockChain) Close() error {
+	err := bc.chain.Close()
+	if ierr := bc.index.Close(); err == nil {
+		err = ierr
 	}
-	b := new(Block)
-	err = b.UnmarshalBinary(bin)
-	return b, err
+	return err
 }
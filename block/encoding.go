@@ -0,0 +1,175 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Canonical binary encoding shared by everything that gets hashed.
+// Integers are fixed width big endian, and byte strings are prefixed
+// by their length, so every value has exactly one encoding.
+
+var errShort = errors.New("block: encoding too short")
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf.WriteByte(v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) int(v int) {
+	e.uint64(uint64(int64(v)))
+}
+
+func (e *encoder) float64(v float64) {
+	e.uint64(math.Float64bits(v))
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) list(ls [][]byte) {
+	e.uint32(uint32(len(ls)))
+	for _, b := range ls {
+		e.bytes(b)
+	}
+}
+
+func (e *encoder) lists(ls [][][]byte) {
+	e.uint32(uint32(len(ls)))
+	for _, l := range ls {
+		e.list(l)
+	}
+}
+
+func (e *encoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// Decodes what encoder wrote. The first error sticks, and every
+// read after it returns zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = errShort
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) int() int {
+	return int(int64(d.uint64()))
+}
+
+func (d *decoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+// return: a copy of the next byte string; nil if it is empty
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if n == 0 || d.err != nil {
+		return nil
+	}
+	if uint64(n) > uint64(len(d.data)) {
+		d.err = errShort
+		return nil
+	}
+	return append([]byte(nil), d.next(int(n))...)
+}
+
+// return: the next list of byte strings; nil if it is empty
+func (d *decoder) list() [][]byte {
+	n := d.count(4)
+	if n == 0 {
+		return nil
+	}
+	res := make([][]byte, n)
+	for i := range res {
+		res[i] = d.bytes()
+	}
+	return res
+}
+
+// return: the next list of lists of byte strings; nil if it is empty
+func (d *decoder) lists() [][][]byte {
+	n := d.count(4)
+	if n == 0 {
+		return nil
+	}
+	res := make([][][]byte, n)
+	for i := range res {
+		res[i] = d.list()
+	}
+	return res
+}
+
+// Number of elements in a list that follows. Every element takes at
+// least min bytes, which bounds allocations on bogus input.
+func (d *decoder) count(min int) int {
+	n := d.uint32()
+	if d.err == nil && uint64(n)*uint64(min) > uint64(len(d.data)) {
+		d.err = errShort
+		return 0
+	}
+	return int(n)
+}
+
+// return: the first error, or an error if there are bytes left over
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("block: trailing bytes after encoding")
+	}
+	return d.err
+}
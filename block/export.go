@@ -0,0 +1,190 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Implements exporting a chain to a portable file, and importing it.
+//
+// An export is
+//     magic    "spacemint export"
+//     version  byte
+//     network  name of the network, length prefixed
+// followed by the blocks from the genesis block on, as records (see
+// record.go). Exports are read from the chain file without opening
+// the chain, so they can be made while a node runs: the records are
+// checked as they are read, and one cut short at the end, which the
+// node is still writing, ends the export.
+//
+// Importing checks every block as if it came from a peer. Blocks the
+// chain already has are skipped, so an import that stopped can be run
+// again and resumes after the last block it added.
+
+const (
+	exportMagic   = "spacemint export"
+	exportVersion = 1
+)
+
+// Call f on the blocks in the chain file fn, in order, until f
+// returns an error
+func walkChain(fn string, f func(*Block) error) error {
+	file, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	for off := int64(0); off < stat.Size(); {
+		b, next, err := readRecord(file, off, stat.Size())
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("block: %s: %v", fn, CorruptRecord{off, err})
+		}
+		if err := f(b); err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
+
+// Export the chain of network net in file fn to w. Pruned blocks can't
+// be checked on import, so only archival chains can be exported.
+// return: the number of blocks exported
+func ExportChain(fn string, net *ChainParams, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	e := new(encoder)
+	e.buf.WriteString(exportMagic)
+	e.uint8(exportVersion)
+	e.bytes([]byte(net.Name))
+	bw.Write(e.Bytes())
+
+	n := 0
+	genesis := net.Genesis().ID()
+	err := walkChain(fn, func(b *Block) error {
+		if b.Id != n {
+			return fmt.Errorf("block: block %d of %s has id %d", n, fn, b.Id)
+		}
+		if n == 0 && !bytes.Equal(b.ID(), genesis) {
+			return fmt.Errorf("block: %s is not a %s chain", fn, net.Name)
+		}
+		if b.Pruned() {
+			return fmt.Errorf("block: the answer of block %d is pruned", n)
+		}
+		rec, err := encodeRecord(b)
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(rec); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// A block as ExportJSON writes it
+type JSONBlock struct {
+	Hash string // hex of the block's id; see Header.ID
+	*Block
+}
+
+// Export the chain in file fn to w as JSON, one block per line, for
+// analysis; it can't be imported
+// return: the number of blocks exported
+func ExportJSON(fn string, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	err := walkChain(fn, func(b *Block) error {
+		n++
+		return enc.Encode(&JSONBlock{hex.EncodeToString(b.ID()), b})
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// Add the blocks exported to r to the end of bc, checking each one
+// like Insert does
+// return: the number of blocks added; on an error, the blocks before
+//         the bad one stay added
+func ImportChain(bc *BlockChain, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(exportMagic)+1+4)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return 0, err
+	}
+	if string(head[:len(exportMagic)]) != exportMagic {
+		return 0, errors.New("block: not an export")
+	}
+	d := &decoder{data: head[len(exportMagic):]}
+	if v := d.uint8(); v != exportVersion {
+		return 0, fmt.Errorf("block: unknown export version %d", v)
+	}
+	nlen := d.uint32()
+	if nlen > 255 {
+		return 0, errors.New("block: export has a bad network name")
+	}
+	name := make([]byte, nlen)
+	if _, err := io.ReadFull(br, name); err != nil {
+		return 0, err
+	}
+	if bc.Net != nil && string(name) != bc.Net.Name {
+		return 0, fmt.Errorf("block: export is of %s, not %s", name, bc.Net.Name)
+	}
+
+	n := 0
+	for {
+		b, err := readRecordFrom(br)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("block: export after block %d: %v", bc.LastBlock, err)
+		}
+
+		if b.Id < 0 {
+			return n, fmt.Errorf("block: export has a block with id %d", b.Id)
+		}
+		if b.Id <= bc.LastBlock {
+			if bc.hashes[b.Id] != string(b.ID()) {
+				return n, fmt.Errorf("block: export differs from the chain at block %d", b.Id)
+			}
+			continue
+		}
+		if b.Id != bc.LastBlock+1 {
+			return n, fmt.Errorf("block: export skips from block %d to %d", bc.LastBlock, b.Id)
+		}
+		// the genesis block of an empty chain is taken as it is
+		if bc.LastBlock >= 0 {
+			err = ValidateBlock(bc, b)
+		}
+		if err == nil {
+			err = bc.Add(b)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+		bc.prune()
+		if err := bc.autoPrune(); err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Implements forks: blocks that don't extend the last block are kept
+// off the main chain, and the chain switches to a fork once the fork
+// is of better quality.
+//
+// The quality of a branch is the sum of the qualities of its blocks.
+// Two branches are compared on the blocks after the point where they
+// fork, and the main chain only changes for a strictly better branch
+// that is at least as long. A shorter branch never wins, so miners
+// that switch branches never have to sign again at heights they
+// already signed (see Detector).
+
+// Forks from further than this below the last block are rejected
+const ReorgWindow = 100
+
+// Blocks a chain keeps on forks at most
+const maxSide = 10 * ReorgWindow
+
+// Reported to the OnReorg hooks after the chain switched to a fork
+type Reorg struct {
+	Fork    int      // last block both branches share
+	Removed []*Block // blocks that left the main chain, in order
+	Added   []*Block // blocks that joined it, in order
+}
+
+// Call f after every switch to a fork
+func (bc *BlockChain) OnReorg(f func(*Reorg)) {
+	bc.hooks = append(bc.hooks, f)
+}
+
+// Call f after every block that joins the main chain, whether it
+// extends the chain or comes in with a fork
+func (bc *BlockChain) OnBlock(f func(*Block)) {
+	bc.blockHooks = append(bc.blockHooks, f)
+}
+
+// return: whether b is on the main chain
+func (bc *BlockChain) OnMain(b *Block) bool {
+	_, ok := bc.heights[string(b.ID())]
+	return ok
+}
+
+// Add b to the chain, or to a fork of it. A block extending the last
+// block has to pass ValidateBlock. A block on a fork has to follow its
+// parent, answer the challenge of its branch and be signed, with a
+// registered commitment; its transactions are checked with the rest
+// of its branch once the branch is better than the main chain. If
+// that check fails, the main chain stays as it was and the bad block
+// is dropped.
+func (bc *BlockChain) Insert(b *Block) error {
+	hash := b.ID()
+	if _, ok := bc.side[string(hash)]; ok || bc.OnMain(b) {
+		return nil
+	}
+	if bc.LastBlock >= 0 && string(b.Prev) == bc.hashes[bc.LastBlock] {
+		if err := ValidateBlock(bc, b); err != nil {
+			return err
+		}
+		if err := bc.Add(b); err != nil {
+			return err
+		}
+		bc.prune()
+		// b stays on the chain even if pruning fails
+		return bc.autoPrune()
+	}
+
+	parent, ok := bc.side[string(b.Prev)]
+	if !ok {
+		parent = bc.mainParent(b)
+		if parent == nil {
+			return errors.New("block: unknown parent")
+		}
+	}
+	branch, fork := bc.branch(b)
+	if fork < bc.LastBlock-ReorgWindow {
+		return fmt.Errorf("block: fork from block %d is too old", fork)
+	}
+	if len(bc.side) >= maxSide {
+		return errors.New("block: too many blocks on forks")
+	}
+	if err := bc.checkSide(parent, b); err != nil {
+		return err
+	}
+	bc.side[string(hash)] = b
+
+	if fork > bc.LastBlock || bc.hashes[fork] != string(branch[0].Prev) {
+		// the branch forks from blocks that left the main chain
+		return nil
+	}
+	better, err := bc.better(branch, fork)
+	if err != nil || !better {
+		return err
+	}
+	return bc.reorg(branch, fork)
+}
+
+// Check the rules a block on a fork follows without its transactions:
+// see validateHeader and Registry.CheckProof
+func (bc *BlockChain) checkSide(parent, b *Block) error {
+	challenge, err := bc.idOn(parent, challengeBlock(parent.Id, bc.Dist))
+	if err != nil {
+		return err
+	}
+	if err := validateHeader(&parent.Header, challenge, &b.Header, &b.Proof, bc.Params); err != nil {
+		return err
+	}
+	if err := bc.Commits.CheckProof(b); err != nil {
+		return invalid(RuleCommitment, err)
+	}
+	return nil
+}
+
+// return: the id of the block at height h on the branch that ends
+//         with tip, a block on the main chain or a fork
+func (bc *BlockChain) idOn(tip *Block, h int) ([]byte, error) {
+	b := tip
+	for b.Id > h {
+		parent, ok := bc.side[string(b.Prev)]
+		if !ok {
+			break
+		}
+		b = parent
+	}
+	if b.Id == h {
+		return b.ID(), nil
+	}
+	return bc.IdAt(h)
+}
+
+// return: the main chain block b follows, if any
+func (bc *BlockChain) mainParent(b *Block) *Block {
+	i := b.Id - 1
+	if i < 0 || i > bc.LastBlock || bc.hashes[i] != string(b.Prev) {
+		return nil
+	}
+	parent, err := bc.Read(i)
+	if err != nil {
+		return nil
+	}
+	return parent
+}
+
+// return: the side blocks from the main chain up to b, in order, and
+//         the main chain block they fork from
+func (bc *BlockChain) branch(b *Block) ([]*Block, int) {
+	branch := []*Block{b}
+	for {
+		parent, ok := bc.side[string(branch[0].Prev)]
+		if !ok {
+			break
+		}
+		branch = append([]*Block{parent}, branch...)
+	}
+	return branch, branch[0].Id - 1
+}
+
+// return: whether branch, which forks from block fork, is at least as
+//         long as the main chain after fork, and of better quality
+func (bc *BlockChain) better(branch []*Block, fork int) (bool, error) {
+	if len(branch) < bc.LastBlock-fork {
+		return false, nil
+	}
+	var ours, theirs float64
+	for i := fork + 1; i <= bc.LastBlock; i++ {
+		b, err := bc.Read(i)
+		if err != nil {
+			return false, err
+		}
+		ours += b.Quality
+	}
+	for _, b := range branch {
+		theirs += b.Quality
+	}
+	return theirs > ours, nil
+}
+
+// Switch the main chain to branch, which forks from block fork. The
+// branch is checked in full before the chain file changes.
+func (bc *BlockChain) reorg(branch []*Block, fork int) error {
+	if n, err := bc.checkBranch(branch, fork); err != nil {
+		// forget the bad block and the blocks built on it
+		for _, bad := range branch[n:] {
+			hash := bad.ID()
+			delete(bc.side, string(hash))
+		}
+		return err
+	}
+
+	removed, err := bc.truncate(fork)
+	if err != nil {
+		return err
+	}
+	for _, b := range branch {
+		err := bc.Add(b)
+		if err == nil {
+			continue
+		}
+
+		// only writing can fail here; put the old main chain back
+		if _, terr := bc.truncate(fork); terr != nil {
+			return terr
+		}
+		for _, old := range removed {
+			if aerr := bc.Add(old); aerr != nil {
+				return aerr
+			}
+		}
+		return err
+	}
+
+	for _, b := range branch {
+		hash := b.ID()
+		delete(bc.side, string(hash))
+	}
+	for _, b := range removed {
+		hash := b.ID()
+		bc.side[string(hash)] = b
+	}
+	bc.prune()
+
+	r := &Reorg{
+		Fork:    fork,
+		Removed: removed,
+		Added:   branch,
+	}
+	for _, f := range bc.hooks {
+		f(r)
+	}
+	return nil
+}
+
+// Check that branch, which forks from block fork, can replace the main
+// chain after fork. The UTXO set and registry are rolled back to fork
+// for the check, and put back after.
+// return: the number of blocks of branch that pass, and why the next
+//         one doesn't
+func (bc *BlockChain) checkBranch(branch []*Block, fork int) (int, error) {
+	prev, err := bc.Read(fork)
+	if err != nil {
+		return 0, err
+	}
+	var removed []*Block
+	for i := fork + 1; i <= bc.LastBlock; i++ {
+		b, err := bc.Read(i)
+		if err != nil {
+			return 0, err
+		}
+		removed = append(removed, b)
+	}
+	for i := len(removed) - 1; i >= 0; i-- {
+		bc.rollback(removed[i])
+	}
+
+	n := 0
+	for _, b := range branch {
+		var challenge []byte
+		challenge, err = bc.idOn(prev, challengeBlock(prev.Id, bc.Dist))
+		if err == nil {
+			err = checkNext(bc, &prev.Header, challenge, b)
+		}
+		if err != nil {
+			break
+		}
+		n++
+		prev = b
+	}
+
+	for i := n - 1; i >= 0; i-- {
+		bc.rollback(branch[i])
+	}
+	for _, b := range removed {
+		if aerr := bc.apply(b); aerr != nil {
+			return n, aerr
+		}
+	}
+	return n, err
+}
+
+// Remove the blocks after block height from the main chain, undoing
+// their transactions
+// return: the removed blocks, in order
+func (bc *BlockChain) truncate(height int) ([]*Block, error) {
+	var removed []*Block
+	for i := height + 1; i <= bc.LastBlock; i++ {
+		b, err := bc.Read(i)
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, b)
+	}
+	for i := len(removed) - 1; i >= 0; i-- {
+		bc.rollback(removed[i])
+	}
+
+	end := bc.seekIndex[height+1]
+	if err := bc.chain.Truncate(end); err != nil {
+		return nil, err
+	}
+	if _, err := bc.chain.Seek(end, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := bc.index.Truncate(int64(8 * (height + 1))); err != nil {
+		return nil, err
+	}
+	for i := height + 2; i <= bc.LastBlock+1; i++ {
+		delete(bc.seekIndex, i)
+	}
+	for _, hash := range bc.hashes[height+1:] {
+		delete(bc.heights, hash)
+	}
+	bc.hashes = bc.hashes[:height+1]
+	bc.LastBlock = height
+	if bc.pruned > height {
+		bc.pruned = height
+	}
+	return removed, nil
+}
+
+// Forget side blocks that are too old to ever be reorganized to, and
+// how to roll back the main chain blocks no fork can replace
+func (bc *BlockChain) prune() {
+	for hash, b := range bc.side {
+		if b.Id <= bc.LastBlock-ReorgWindow {
+			delete(bc.side, hash)
+		}
+	}
+	bc.UTXO.Forget(bc.LastBlock - ReorgWindow)
+}
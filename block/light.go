@@ -0,0 +1,162 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/kwonalbert/spacemint/pos"
+)
+
+// Implements a light client: it keeps only the headers of the chain,
+// and checks that transactions are in blocks with merkle proofs.
+//
+// Each header is checked with the proof of space it commits to, which
+// is dropped once checked. Light clients can't see the transactions
+// that register commitments, so they trust that the proofs use
+// registered commitments, and they follow the chain they are given
+// rather than choosing between forks. They sync from archival nodes,
+// since pruned ones no longer have the proofs of old blocks.
+
+// A header and the proof of space it commits to; what a light client
+// needs to check a block
+type ProvenHeader struct {
+	Header Header
+	Proof  PoS
+}
+
+// Proof that a transaction is in a block
+type TxProof struct {
+	Block []byte   // id of the block
+	Index int      // position of the transaction in the block
+	Count int      // number of transactions in the block
+	Path  [][]byte // see MerkleProof
+	Tx    Transaction
+}
+
+// return: the headers of blocks from up to and including to, with
+//         their proofs; an error if some of the proofs were pruned
+func (bc *BlockChain) Headers(from, to int) ([]ProvenHeader, error) {
+	if bc.pruned > 0 && from <= bc.pruned {
+		return nil, fmt.Errorf("block: proofs up to block %d are pruned", bc.pruned)
+	}
+	var res []ProvenHeader
+	err := bc.Range(from, to, func(b *Block) bool {
+		res = append(res, ProvenHeader{b.Header, b.Proof})
+		return true
+	})
+	return res, err
+}
+
+// return: a proof that the transaction with id tid is in the main chain
+func (bc *BlockChain) ProveTx(tid []byte) (*TxProof, error) {
+	var res *TxProof
+	err := bc.Reverse(func(b *Block) bool {
+		ids := make([][]byte, len(b.Trans))
+		for i := range b.Trans {
+			ids[i] = b.Trans[i].Id()
+		}
+		for i := range ids {
+			if bytes.Equal(ids[i], tid) {
+				res = &TxProof{
+					Block: b.ID(),
+					Index: i,
+					Count: len(ids),
+					Path:  MerkleProof(ids, i),
+					Tx:    b.Trans[i],
+				}
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, fmt.Errorf("block: no transaction %x in chain", tid)
+	}
+	return res, nil
+}
+
+type LightChain struct {
+	headers   []Header
+	heights   map[string]int // height of each header by block id
+	LastBlock int            // last header that was added
+	Dist      int            // how far to look back for challenge
+	Params    *pos.Params    // proof of space parameters
+}
+
+// Light chain of network p, which starts from its genesis block
+func NewLightChain(p *ChainParams) *LightChain {
+	genesis := p.Genesis().Header
+	lc := LightChain{
+		headers:   []Header{genesis},
+		heights:   map[string]int{string(genesis.ID()): genesis.Id},
+		LastBlock: genesis.Id,
+		Dist:      p.Dist,
+		Params:    &p.PoS,
+	}
+	return &lc
+}
+
+// return: the ith header
+func (lc *LightChain) Header(i int) (*Header, error) {
+	first := lc.headers[0].Id
+	if i < first || i > lc.LastBlock {
+		return nil, fmt.Errorf("block: no header %d in light chain", i)
+	}
+	return &lc.headers[i-first], nil
+}
+
+// Check ph, and add its header to the end of the chain
+// return: nil, or a *BlockError for the first rule ph breaks
+func (lc *LightChain) Add(ph *ProvenHeader) error {
+	last, _ := lc.Header(lc.LastBlock)
+	cb, err := lc.Header(challengeBlock(lc.LastBlock, lc.Dist))
+	if err != nil {
+		return err
+	}
+	if err := validateHeader(last, cb.ID(), &ph.Header, &ph.Proof, lc.Params); err != nil {
+		return err
+	}
+	lc.headers = append(lc.headers, ph.Header)
+	lc.LastBlock++
+	lc.heights[string(ph.Header.ID())] = lc.LastBlock
+	return nil
+}
+
+// Add the headers in phs that extend the chain, in order, skipping
+// the ones the chain already has
+// return: the number of headers added
+func (lc *LightChain) Sync(phs []ProvenHeader) (int, error) {
+	n := 0
+	for i := range phs {
+		if _, ok := lc.heights[string(phs[i].Header.ID())]; ok {
+			continue
+		}
+		if err := lc.Add(&phs[i]); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Check that the transaction in p is in a block of the chain
+// return: the number of confirmations the transaction has; 1 if it is
+//         in the last block
+func (lc *LightChain) VerifyTx(p *TxProof) (int, error) {
+	i, ok := lc.heights[string(p.Block)]
+	if !ok {
+		return 0, errors.New("block: transaction is in an unknown block")
+	}
+	if _, err := p.Tx.MarshalBinary(); err != nil {
+		return 0, err
+	}
+	h, _ := lc.Header(i)
+	if !VerifyMerkle(h.TxRoot, p.Tx.Id(), p.Index, p.Count, p.Path) {
+		return 0, errors.New("block: bad merkle proof")
+	}
+	return lc.LastBlock - i + 1, nil
+}
@@ -0,0 +1,340 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// Implements the pool of transactions waiting to get into a block.
+//
+// The pool only holds transactions that apply on top of the main
+// chain: payments have to spend outputs that are already in a block,
+// and no two transactions in the pool spend the same output or punish
+// the same miner, and no payment spends the rewards of a miner the
+// pool punishes. A block joining the main chain removes its
+// transactions from the pool, along with the ones it conflicts with.
+// Blocks leaving it in a reorg give their transactions back.
+
+// Default for Mempool.MaxSize
+const MempoolSize = 32 << 20
+
+type Mempool struct {
+	MaxSize int // bytes of transactions the pool holds; 0 for no limit
+
+	chain    *BlockChain
+	txs      map[string]*pooled  // by transaction id
+	spends   map[outpoint]string // payment in the pool spending each output
+	punishes map[string]string   // punishment in the pool of each pk
+	size     int                 // bytes of transactions held
+}
+
+// A transaction in the pool
+type pooled struct {
+	tx   Transaction
+	id   string
+	fee  uint64
+	size int // of the encoded transaction
+}
+
+// Pool for the transactions of chain, which keeps it up to date
+func NewMempool(chain *BlockChain) *Mempool {
+	mp := Mempool{
+		MaxSize:  MempoolSize,
+		chain:    chain,
+		txs:      make(map[string]*pooled),
+		spends:   make(map[outpoint]string),
+		punishes: make(map[string]string),
+	}
+	chain.OnBlock(mp.confirm)
+	chain.OnReorg(mp.reorg)
+	return &mp
+}
+
+// return: the number of transactions in the pool
+func (mp *Mempool) Len() int {
+	return len(mp.txs)
+}
+
+// return: the bytes of transactions in the pool
+func (mp *Mempool) Size() int {
+	return mp.size
+}
+
+// return: whether the transaction with id tid is in the pool
+func (mp *Mempool) Has(tid []byte) bool {
+	_, ok := mp.txs[string(tid)]
+	return ok
+}
+
+// return: whether a payment in the pool spends output k of the
+//         transaction with id tid
+func (mp *Mempool) Spends(tid []byte, k int) bool {
+	_, ok := mp.spends[outpoint{string(tid), k}]
+	return ok
+}
+
+// Add t to the pool. A payment replaces the payments it conflicts
+// with if it pays more fees than all of them, and more per byte than
+// each. A punishment replaces the payments of the rewards it takes
+// back. A full pool drops the payments paying the least per byte to
+// make room.
+func (mp *Mempool) Accept(t *Transaction) error {
+	bin, err := t.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p := &pooled{tx: *t, id: string(t.Id()), size: len(bin)}
+	if _, ok := mp.txs[p.id]; ok {
+		return errors.New("block: transaction already in pool")
+	}
+	if err := mp.check(p); err != nil {
+		return err
+	}
+
+	conflicts := mp.conflicts(&p.tx)
+	var fees uint64
+	for _, c := range conflicts {
+		if p.tx.Type == Punishment && c.tx.Type == Payment {
+			continue
+		}
+		if p.tx.Type != Payment || c.tx.Type != Payment || feeRate(p, c) <= 0 {
+			return errors.New("block: transaction conflicts with one in the pool")
+		}
+		fees += c.fee
+	}
+	if len(conflicts) > 0 && p.tx.Type == Payment && p.fee <= fees {
+		return errors.New("block: replacement doesn't pay more fees than it replaces")
+	}
+
+	// make sure t stays before replacing or evicting anything
+	size := mp.size + p.size
+	replaced := make(map[string]bool)
+	for _, c := range conflicts {
+		size -= c.size
+		replaced[c.id] = true
+	}
+	if mp.MaxSize > 0 {
+		ps := mp.sorted()
+		for i := len(ps) - 1; i >= 0 && size > mp.MaxSize; i-- {
+			if ps[i].before(p) {
+				break
+			}
+			if !replaced[ps[i].id] {
+				size -= ps[i].size
+			}
+		}
+		if size > mp.MaxSize {
+			return errors.New("block: pool is full of transactions paying more")
+		}
+	}
+
+	for _, c := range conflicts {
+		mp.drop(c)
+	}
+	mp.add(p)
+	mp.evict()
+	return nil
+}
+
+// return: the transactions for a block after the last one of the
+//         chain, paying pk the reward. They are the ones of highest
+//         priority that fit in limit bytes of block, reward included.
+func (mp *Mempool) Template(pk []byte, limit int) ([]Transaction, error) {
+	// a reward has the same size whatever it pays
+	rw := Transaction{Type: Reward, Out: []Out{{PkHash: PkHash(pk), Coins: 1}}, J: 1}
+	bin, err := rw.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	limit -= 4 + len(bin)
+	if limit < 0 {
+		return nil, nil
+	}
+
+	var ts []Transaction
+	for _, p := range mp.sorted() {
+		// lists in blocks are prefixed by their length
+		if 4+p.size <= limit {
+			ts = append(ts, p.tx)
+			limit -= 4 + p.size
+		}
+	}
+	return mp.chain.WithReward(pk, ts)
+}
+
+// return: the transactions in the pool, highest priority first
+func (mp *Mempool) sorted() []*pooled {
+	ps := make([]*pooled, 0, len(mp.txs))
+	for _, p := range mp.txs {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].before(ps[j])
+	})
+	return ps
+}
+
+// return: whether p goes into blocks before q, and is dropped from a
+//         full pool after q. Commitments and punishments go first,
+//         then payments by fee per byte.
+func (p *pooled) before(q *pooled) bool {
+	if (p.tx.Type == Payment) != (q.tx.Type == Payment) {
+		return q.tx.Type == Payment
+	}
+	if c := feeRate(p, q); c != 0 {
+		return c > 0
+	}
+	return p.id < q.id
+}
+
+// return: the sign of the fee per byte of p minus that of q
+func feeRate(p, q *pooled) int {
+	// compare p.fee/p.size with q.fee/q.size without rounding
+	hp, lp := bits.Mul64(p.fee, uint64(q.size))
+	hq, lq := bits.Mul64(q.fee, uint64(p.size))
+	switch {
+	case hp > hq || hp == hq && lp > lq:
+		return 1
+	case hp == hq && lp == lq:
+		return 0
+	}
+	return -1
+}
+
+// Check that p's transaction applies on top of the main chain, and
+// set its fee
+func (mp *Mempool) check(p *pooled) error {
+	t := &p.tx
+	switch t.Type {
+	case Payment:
+		fee, err := mp.chain.UTXO.Validate(t)
+		p.fee = fee
+		return err
+	case SpaceCommit, Punishment:
+		// dry run the registry
+		b := &Block{
+			Header: Header{Id: mp.chain.LastBlock + 1},
+			Body:   Body{Trans: []Transaction{*t}},
+		}
+		if err := mp.chain.Commits.Apply(b); err != nil {
+			return err
+		}
+		return mp.chain.Commits.Rollback(b)
+	}
+	return errors.New("block: rewards only go in blocks")
+}
+
+// return: the transactions in the pool that can't go in a block with t
+func (mp *Mempool) conflicts(t *Transaction) []*pooled {
+	var res []*pooled
+	seen := make(map[string]bool)
+	found := func(id string, ok bool) {
+		if ok && !seen[id] {
+			seen[id] = true
+			res = append(res, mp.txs[id])
+		}
+	}
+	u := mp.chain.UTXO
+	switch t.Type {
+	case Payment:
+		for _, in := range t.In {
+			op := outpoint{string(in.Tid), in.K}
+			id, ok := mp.spends[op]
+			found(id, ok)
+			if !u.rewards[op] {
+				continue
+			}
+			for pk, id := range mp.punishes {
+				found(id, bytes.Equal(PkHash([]byte(pk)), u.outs[op].PkHash))
+			}
+		}
+	case Punishment:
+		id, ok := mp.punishes[string(t.Pk)]
+		found(id, ok)
+		hash := PkHash(t.Pk)
+		for op, id := range mp.spends {
+			found(id, u.rewards[op] && bytes.Equal(u.outs[op].PkHash, hash))
+		}
+	}
+	return res
+}
+
+func (mp *Mempool) add(p *pooled) {
+	mp.txs[p.id] = p
+	mp.size += p.size
+	switch p.tx.Type {
+	case Payment:
+		for _, in := range p.tx.In {
+			mp.spends[outpoint{string(in.Tid), in.K}] = p.id
+		}
+	case Punishment:
+		mp.punishes[string(p.tx.Pk)] = p.id
+	}
+}
+
+func (mp *Mempool) drop(p *pooled) {
+	delete(mp.txs, p.id)
+	mp.size -= p.size
+	switch p.tx.Type {
+	case Payment:
+		for _, in := range p.tx.In {
+			delete(mp.spends, outpoint{string(in.Tid), in.K})
+		}
+	case Punishment:
+		delete(mp.punishes, string(p.tx.Pk))
+	}
+}
+
+// Drop the transactions of lowest priority until the pool fits
+func (mp *Mempool) evict() {
+	if mp.MaxSize <= 0 || mp.size <= mp.MaxSize {
+		return
+	}
+	ps := mp.sorted()
+	for i := len(ps) - 1; i >= 0 && mp.size > mp.MaxSize; i-- {
+		mp.drop(ps[i])
+	}
+}
+
+// Remove the transactions in b, which joined the main chain, and the
+// ones that conflict with them
+func (mp *Mempool) confirm(b *Block) {
+	punished := false
+	for i := range b.Trans {
+		t := &b.Trans[i]
+		if p, ok := mp.txs[string(t.Id())]; ok {
+			mp.drop(p)
+		}
+		for _, c := range mp.conflicts(t) {
+			mp.drop(c)
+		}
+		punished = punished || t.Type == Punishment
+	}
+	// the rewards b took back are gone from the UTXO set already
+	if punished {
+		for _, p := range mp.txs {
+			if p.tx.Type == Payment && mp.check(p) != nil {
+				mp.drop(p)
+			}
+		}
+	}
+}
+
+// Drop the transactions that spent outputs of the blocks that left the
+// main chain, and take back the transactions of those blocks
+func (mp *Mempool) reorg(r *Reorg) {
+	for _, p := range mp.txs {
+		if mp.check(p) != nil {
+			mp.drop(p)
+		}
+	}
+	for _, b := range r.Removed {
+		for i := range b.Trans {
+			if b.Trans[i].Type != Reward {
+				mp.Accept(&b.Trans[i])
+			}
+		}
+	}
+}
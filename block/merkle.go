@@ -0,0 +1,102 @@
+package block
+
+import (
+	"bytes"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Merkle tree over the transactions of a block, so that a transaction
+// can be shown to be in a block with only the block's header.
+//
+// Leaves and inner nodes are hashed with different prefixes, so a leaf
+// can't pass for a node. A node without a sibling moves up a level as
+// it is, rather than being paired with itself.
+
+const (
+	leafPrefix = 0
+	nodePrefix = 1
+)
+
+func leafHash(leaf []byte) []byte {
+	h := sha3.Sum256(append([]byte{leafPrefix}, leaf...))
+	return h[:]
+}
+
+func nodeHash(left, right []byte) []byte {
+	buf := make([]byte, 0, 1+len(left)+len(right))
+	buf = append(buf, nodePrefix)
+	buf = append(buf, left...)
+	buf = append(buf, right...)
+	h := sha3.Sum256(buf)
+	return h[:]
+}
+
+// return: the merkle root of leaves; the hash of nothing if there are
+//         no leaves
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		h := sha3.Sum256(nil)
+		return h[:]
+	}
+	level := make([][]byte, len(leaves))
+	for i := range leaves {
+		level[i] = leafHash(leaves[i])
+	}
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+	return level[0]
+}
+
+func nextLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, nodeHash(level[i], level[i+1]))
+		}
+	}
+	return next
+}
+
+// return: the siblings on the path from the ith leaf to the root
+func MerkleProof(leaves [][]byte, i int) [][]byte {
+	level := make([][]byte, len(leaves))
+	for j := range leaves {
+		level[j] = leafHash(leaves[j])
+	}
+	var proof [][]byte
+	for len(level) > 1 {
+		if sib := i ^ 1; sib < len(level) {
+			proof = append(proof, level[sib])
+		}
+		level = nextLevel(level)
+		i /= 2
+	}
+	return proof
+}
+
+// Check that leaf is the ith of n leaves under root
+func VerifyMerkle(root, leaf []byte, i, n int, proof [][]byte) bool {
+	if i < 0 || i >= n {
+		return false
+	}
+	cur := leafHash(leaf)
+	for ; n > 1; n = (n + 1) / 2 {
+		if sib := i ^ 1; sib < n {
+			if len(proof) == 0 {
+				return false
+			}
+			if i%2 == 0 {
+				cur = nodeHash(cur, proof[0])
+			} else {
+				cur = nodeHash(proof[0], cur)
+			}
+			proof = proof[1:]
+		}
+		i /= 2
+	}
+	return len(proof) == 0 && bytes.Equal(cur, root)
+}
@@ -0,0 +1,132 @@
+package block
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/kwonalbert/spacemint/pos"
+	"golang.org/x/crypto/sha3"
+)
+
+// Parameters of a network; every node on a network has to agree on
+// all of them
+type ChainParams struct {
+	Name            string           // tells networks apart; see Genesis
+	AddressPrefix   byte             // first byte of addresses; see Address
+	Commits         []pos.Commitment // registered in the genesis block
+	BlockTime       time.Duration    // how long a round lasts
+	Dist            int              // how far to look back for challenge
+	Reward          uint64           // base units for mining a block, at first
+	HalvingInterval int              // blocks after which Reward halves
+	MaxBlockSize    int              // largest encoded block, in bytes
+	CommitDelay     int              // see Registry.CheckProof
+	PoS             pos.Params       // proof of space parameters
+}
+
+// Preset networks. A chain can't grow without commitments, so each
+// registers its first miners in genesis. Local regtest networks
+// replace them with their own, as the client's -commit flag does.
+var (
+	MainnetParams = ChainParams{
+		Name:          "mainnet",
+		AddressPrefix: 0x3f, // addresses start with S
+		Commits: []pos.Commitment{
+			presetCommit("01b0b8b1af37761125f9599f391f8ee324a92cd90b59442c3facfa914528d3bb88",
+				"8c64fdaf3c1ec1ccca191a45d47879c05b14ca54df0ae937cc5f66b4a625f761"),
+		},
+		BlockTime:       time.Minute,
+		Dist:            10,
+		Reward:          50 * Coin,
+		HalvingInterval: 210000,
+		MaxBlockSize:    1 << 20,
+		CommitDelay:     CommitDelay,
+		PoS:             pos.DefaultParams,
+	}
+	// Small and fast, for tests and local networks
+	RegtestParams = ChainParams{
+		Name:          "regtest",
+		AddressPrefix: 0x6f, // addresses start with m or n
+		Commits: []pos.Commitment{
+			presetCommit("015f623689ca92365f09c36a32c5074e9d8bd0fb6067330a81efe63c50087a04a4",
+				"59ce3b243438e4c141a631e87d09599e21c4db983820babf5cd72d727ae0a1a8"),
+		},
+		BlockTime:       time.Second,
+		Dist:            1,
+		Reward:          50 * Coin,
+		HalvingInterval: 150,
+		MaxBlockSize:    1 << 20,
+		CommitDelay:     1,
+		PoS:             pos.TestParams,
+	}
+)
+
+// Commitment of public key pk to graph root, both in hex
+func presetCommit(pk, root string) pos.Commitment {
+	pkBytes, err := hex.DecodeString(pk)
+	if err != nil {
+		panic(err)
+	}
+	rootBytes, err := hex.DecodeString(root)
+	if err != nil {
+		panic(err)
+	}
+	return pos.Commitment{Pk: pkBytes, Commit: rootBytes}
+}
+
+var chainPresets = map[string]*ChainParams{
+	"mainnet": &MainnetParams,
+	"regtest": &RegtestParams,
+}
+
+// Return a copy of the named preset
+func ChainPreset(name string) (*ChainParams, error) {
+	p, ok := chainPresets[name]
+	if !ok {
+		return nil, fmt.Errorf("block: unknown network %q", name)
+	}
+	res := *p
+	res.Commits = append([]pos.Commitment(nil), p.Commits...)
+	return &res, nil
+}
+
+// return: the genesis block of the network. It registers Commits, and
+//         links to the hash of Name instead of a previous block.
+//         Nobody signs it; everything in it follows from p.
+func (p *ChainParams) Genesis() *Block {
+	ts := make([]Transaction, len(p.Commits))
+	for i := range p.Commits {
+		c := p.Commits[i]
+		ts[i] = Transaction{Type: SpaceCommit, Commit: &c}
+	}
+	root, err := TxRoot(ts)
+	if err != nil {
+		panic(err)
+	}
+	prev := sha3.Sum256([]byte("spacemint " + p.Name))
+	b := Block{
+		Header: Header{
+			Prev:   prev[:],
+			Id:     0,
+			TxRoot: root,
+		},
+		Body: Body{Trans: ts},
+	}
+	if len(ts) == 0 {
+		b.Trans = nil
+	}
+	return &b
+}
+
+// return: the new coins, in base units, for mining block height; on
+//         top of them the miner gets the fees
+func (p *ChainParams) BlockReward(height int) uint64 {
+	if p.HalvingInterval <= 0 {
+		return p.Reward
+	}
+	halvings := height / p.HalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return p.Reward >> uint(halvings)
+}
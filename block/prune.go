@@ -0,0 +1,135 @@
+package block
+
+import (
+	"io"
+	"os"
+)
+
+// Implements pruning: a chain with a PruneDepth drops the answers of
+// the blocks deeper than that, which make up most of a block. The
+// headers, with their proof hashes and qualities, stay, and so do the
+// commitments and challenges; everything but the proofs of space can
+// still be checked and served.
+//
+// The chain file is rewritten to prune, so blocks are pruned in
+// batches. The index is removed before the new file takes the old
+// one's place; a crash in between leaves a chain that is scanned on
+// open, whichever file it ends up with.
+
+// Blocks a chain lets go past its PruneDepth before pruning them
+const pruneBatch = 100
+
+// return: whether b's answer was pruned; the genesis block has none
+//         to prune
+func (b *Block) Pruned() bool {
+	return b.Id > 0 && b.Proof.Answer.Size == 0
+}
+
+// return: whether the chain keeps the answers of all its blocks, and
+//         can serve them to light clients and other nodes
+func (bc *BlockChain) Archival() bool {
+	return bc.PruneDepth <= 0 && bc.pruned == 0
+}
+
+// return: the last block whose answer was pruned; 0 if none was
+func (bc *BlockChain) PrunedTo() int {
+	return bc.pruned
+}
+
+// return: the number of last blocks that keep their answers. Forks
+//         are checked in full, so blocks a fork could replace are
+//         never pruned.
+func (bc *BlockChain) pruneDepth() int {
+	if bc.PruneDepth < ReorgWindow {
+		return ReorgWindow
+	}
+	return bc.PruneDepth
+}
+
+// Prune once a batch of blocks is past PruneDepth
+func (bc *BlockChain) autoPrune() error {
+	if bc.PruneDepth <= 0 || bc.LastBlock-bc.pruneDepth()-bc.pruned < pruneBatch {
+		return nil
+	}
+	return bc.PruneAnswers()
+}
+
+// Drop the answers of the blocks more than PruneDepth below the last
+// block; nothing if PruneDepth is 0
+func (bc *BlockChain) PruneAnswers() error {
+	to := bc.LastBlock - bc.pruneDepth()
+	if bc.PruneDepth <= 0 || to <= bc.pruned {
+		return nil
+	}
+
+	// blocks pruned before are copied as they are
+	start := bc.pruned + 1
+	tmp := bc.fn + ".prune"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	ends, err := bc.writePruned(f, start, to)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	bc.index.Close()
+	err = os.Remove(indexFile(bc.fn))
+	if err == nil || os.IsNotExist(err) {
+		err = os.Rename(tmp, bc.fn)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		if ierr := bc.openIndex(0); ierr != nil {
+			return ierr
+		}
+		return err
+	}
+
+	bc.chain.Close()
+	bc.chain = f
+	for i, end := range ends {
+		bc.seekIndex[i+1] = end
+	}
+	bc.pruned = to
+	return bc.openIndex(0)
+}
+
+// Write the chain to f, without the answers of blocks start to to
+// return: the end of each record in f
+func (bc *BlockChain) writePruned(f *os.File, start, to int) ([]int64, error) {
+	off := bc.seekIndex[start]
+	if _, err := io.Copy(f, io.NewSectionReader(bc.chain, 0, off)); err != nil {
+		return nil, err
+	}
+	ends := make([]int64, 0, bc.LastBlock+1)
+	for i := 0; i < start; i++ {
+		ends = append(ends, bc.seekIndex[i+1])
+	}
+	for i := start; i <= bc.LastBlock; i++ {
+		b, err := bc.Read(i)
+		if err != nil {
+			return nil, err
+		}
+		if i <= to {
+			b.Proof.Answer = Answer{}
+		}
+		rec, err := encodeRecord(b)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(rec); err != nil {
+			return nil, err
+		}
+		off += int64(len(rec))
+		ends = append(ends, off)
+	}
+	return ends, nil
+}
@@ -0,0 +1,123 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Detects and punishes miners that sign two blocks at the same height,
+// e.g. to mine on two forks at once.
+//
+// A miner extending two forks can show its blocks at different
+// heights, but the forks meet below them. With a Chain to look up
+// ancestors in, the detector also checks the blocks the miner signed
+// on the way down each fork, and catches it at a height where it
+// signed on both.
+
+type Detector struct {
+	Chain *BlockChain // looks up the ancestors of observed blocks, if set
+
+	seen map[signer]*Block // first block seen from a miner at a height
+}
+
+// A miner at a height
+type signer struct {
+	commit string // commitment id
+	height int
+}
+
+func NewDetector() *Detector {
+	d := Detector{
+		seen: make(map[signer]*Block),
+	}
+	return &d
+}
+
+// Remember b and its ancestors, and check them against the blocks seen
+// before
+// return: a punishment transaction if b's miner already signed a
+//         different block at the height of b or of one of the
+//         ancestors it signed, otherwise nil
+func (d *Detector) Observe(b *Block) *Transaction {
+	commit := string(CommitmentId(&b.Proof.Commit))
+	if t := d.compare(commit, b); t != nil || d.Chain == nil {
+		return t
+	}
+	prev := b.Prev
+	for i := 0; i < ReorgWindow; i++ {
+		a, err := d.Chain.ReadId(prev)
+		if err != nil {
+			break
+		}
+		if string(CommitmentId(&a.Proof.Commit)) == commit {
+			if t := d.compare(commit, a); t != nil {
+				return t
+			}
+		}
+		prev = a.Prev
+	}
+	return nil
+}
+
+// Remember b, whose commitment has id commit, and check it against the
+// block seen from the miner at its height
+func (d *Detector) compare(commit string, b *Block) *Transaction {
+	key := signer{commit, b.Id}
+	old, ok := d.seen[key]
+	if !ok {
+		d.seen[key] = b
+		return nil
+	}
+
+	m0 := tsigMessage(&old.Header)
+	m1 := tsigMessage(&b.Header)
+	if bytes.Equal(m0, m1) {
+		return nil
+	}
+	t := Transaction{
+		Type: Punishment,
+		Pk:   b.Proof.Commit.Pk,
+		M:    [2][]byte{m0, m1},
+		J:    b.Id,
+		Sig:  [2][]byte{old.Sig.Tsig, b.Sig.Tsig},
+	}
+	if ValidatePunishment(&t) != nil {
+		// the blocks weren't both signed by the miner
+		return nil
+	}
+	return &t
+}
+
+// Forget the blocks below height
+func (d *Detector) Forget(height int) {
+	for key := range d.seen {
+		if key.height < height {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// Check the evidence in a punishment transaction: two different
+// messages for block J, both signed by Pk
+func ValidatePunishment(t *Transaction) error {
+	if t.Type != Punishment {
+		return errors.New("block: not a punishment")
+	}
+	if bytes.Equal(t.M[0], t.M[1]) {
+		return errors.New("block: punishment for signing the same block twice")
+	}
+	for i := range t.M {
+		j, err := tsigHeight(t.M[i])
+		if err != nil {
+			return fmt.Errorf("block: punishment message %d: %v", i, err)
+		}
+		if j != t.J {
+			return fmt.Errorf("block: punishment message %d is for block %d, not %d", i, j, t.J)
+		}
+		if !Verify(t.Pk, t.M[i], t.Sig[i]) {
+			return fmt.Errorf("block: punishment signature %d is bad", i)
+		}
+	}
+	return nil
+}
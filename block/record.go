@@ -0,0 +1,178 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Defines the records blocks are stored in, and a tool to scan and
+// repair a chain file.
+//
+// A record is
+//     length  uint32    length of the encoded block
+//     hash    [32]byte  hash of the block (see Header.ID)
+//     crc     uint32    CRC-32C of length, hash and the encoded block
+//     block   [length]byte
+// so the chain file can be walked, and checked, without an index.
+
+const (
+	hashLen      = 32
+	recordHeader = 4 + hashLen + 4
+	maxRecord    = 1 << 26 // longest record read from a stream
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// return: the record holding block b
+func encodeRecord(b *Block) ([]byte, error) {
+	bin, err := b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	rec := make([]byte, recordHeader, recordHeader+len(bin))
+	binary.BigEndian.PutUint32(rec, uint32(len(bin)))
+	copy(rec[4:], b.ID())
+	rec = append(rec, bin...)
+	crc := crc32.Update(crc32.Checksum(rec[:4+hashLen], crcTable), crcTable, bin)
+	binary.BigEndian.PutUint32(rec[4+hashLen:], crc)
+	return rec, nil
+}
+
+// Read and check the record at off in r, which is size bytes long
+// return: the block, and the offset of the next record
+func readRecord(r io.ReaderAt, off, size int64) (*Block, int64, error) {
+	if size-off < recordHeader {
+		return nil, size, io.ErrUnexpectedEOF
+	}
+	head := make([]byte, recordHeader)
+	if _, err := r.ReadAt(head, off); err != nil {
+		return nil, size, err
+	}
+	n := int64(binary.BigEndian.Uint32(head))
+	next := off + recordHeader + n
+	if next > size {
+		return nil, size, io.ErrUnexpectedEOF
+	}
+	bin := make([]byte, n)
+	if _, err := r.ReadAt(bin, off+recordHeader); err != nil {
+		return nil, next, err
+	}
+	b, err := checkRecord(head, bin)
+	return b, next, err
+}
+
+// Read and check the next record in r
+// return: the block; io.EOF if r ends before the record starts
+func readRecordFrom(r io.Reader) (*Block, error) {
+	head := make([]byte, recordHeader)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head)
+	if n > maxRecord {
+		return nil, fmt.Errorf("record of %d bytes is too long", n)
+	}
+	bin := make([]byte, n)
+	if _, err := io.ReadFull(r, bin); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return checkRecord(head, bin)
+}
+
+// return: the block in a record with header head and body bin
+func checkRecord(head, bin []byte) (*Block, error) {
+	crc := crc32.Update(crc32.Checksum(head[:4+hashLen], crcTable), crcTable, bin)
+	if crc != binary.BigEndian.Uint32(head[4+hashLen:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	b := new(Block)
+	if err := b.UnmarshalBinary(bin); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(b.ID(), head[4:4+hashLen]) {
+		return nil, errors.New("block does not match its hash")
+	}
+	return b, nil
+}
+
+// A record ScanChain could not read
+type CorruptRecord struct {
+	Offset int64
+	Err    error
+}
+
+func (c CorruptRecord) String() string {
+	return fmt.Sprintf("record at %d: %v", c.Offset, c.Err)
+}
+
+type ScanReport struct {
+	Size    int64           // size of the chain file
+	Ends    []int64         // end of each good record before the first bad one
+	Corrupt []CorruptRecord // every record that failed to read
+}
+
+// return: whether the only damage is a record cut short at the end of
+//         the file, as left by a crash during Add
+func (r *ScanReport) Torn() bool {
+	return len(r.Corrupt) == 1 && r.Corrupt[0].Err == io.ErrUnexpectedEOF
+}
+
+// Walk the records in r, which is size bytes long, from offset start.
+// Records after a bad one are still checked, as long as the bad
+// record's length stays within the file.
+func scanRecords(r io.ReaderAt, start, size int64) *ScanReport {
+	rep := &ScanReport{Size: size}
+	for off := start; off < size; {
+		_, next, err := readRecord(r, off, size)
+		if err != nil {
+			rep.Corrupt = append(rep.Corrupt, CorruptRecord{off, err})
+		} else if len(rep.Corrupt) == 0 {
+			rep.Ends = append(rep.Ends, next)
+		}
+		off = next
+	}
+	return rep
+}
+
+// Check every record of the chain in fn, without using its index
+func ScanChain(fn string) (*ScanReport, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(f, 0, stat.Size()), nil
+}
+
+// Cut the chain in fn down to the good records before the first bad
+// one, and rebuild its index
+// return: the report of the scan done before repairing
+func RepairChain(fn string) (*ScanReport, error) {
+	rep, err := ScanChain(fn)
+	if err != nil {
+		return nil, err
+	}
+	end := int64(0)
+	if len(rep.Ends) > 0 {
+		end = rep.Ends[len(rep.Ends)-1]
+	}
+	if err := os.Truncate(fn, end); err != nil {
+		return nil, err
+	}
+	if err := writeIndex(indexFile(fn), rep.Ends); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
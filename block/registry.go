@@ -0,0 +1,263 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/kwonalbert/spacemint/pos"
+	"golang.org/x/crypto/sha3"
+)
+
+// Defines and implements the registry of space commitments
+
+// Number of blocks a commitment has to be on chain before it can mine
+const CommitDelay = 10
+
+// version of the registry file
+const registryVersion = 1
+
+type Registered struct {
+	Commit  pos.Commitment
+	Height  int // block the commitment was registered in
+	Revoked int // block that punished the owner; 0 if never
+}
+
+type Registry struct {
+	delay  int
+	height int // last applied block
+	byId   map[string]*Registered
+	byPk   map[string][]*Registered
+}
+
+// return: the id of a commitment; the hash of its pk and root
+func CommitmentId(c *pos.Commitment) []byte {
+	e := new(encoder)
+	e.bytes(c.Pk)
+	e.bytes(c.Commit)
+	id := sha3.Sum256(e.Bytes())
+	return id[:]
+}
+
+func NewRegistry(delay int) *Registry {
+	r := Registry{
+		delay:  delay,
+		height: -1,
+		byId:   make(map[string]*Registered),
+		byPk:   make(map[string][]*Registered),
+	}
+	return &r
+}
+
+// return: the commitment with id, if it is registered
+func (r *Registry) ById(id []byte) (*Registered, bool) {
+	reg, ok := r.byId[string(id)]
+	return reg, ok
+}
+
+// return: all commitments registered under pk
+func (r *Registry) ByPk(pk []byte) []*Registered {
+	return r.byPk[string(pk)]
+}
+
+// return: whether pk was punished for signing two blocks at once
+func (r *Registry) Punished(pk []byte) bool {
+	for _, reg := range r.byPk[string(pk)] {
+		if reg.Revoked != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Height of the last block applied to the registry
+func (r *Registry) Height() int {
+	return r.height
+}
+
+// Check that the proof of space in b uses a commitment that was
+// registered at least delay blocks before b
+func (r *Registry) CheckProof(b *Block) error {
+	c := &b.Proof.Commit
+	reg, ok := r.ById(CommitmentId(c))
+	if !ok {
+		return errors.New("block: proof uses an unregistered commitment")
+	}
+	if reg.Revoked != 0 {
+		return errors.New("block: proof uses a revoked commitment")
+	}
+	// commitments from the genesis block can mine right away
+	if reg.Height != 0 && b.Id-reg.Height < r.delay {
+		return fmt.Errorf("block: commitment registered %d blocks ago; needs %d",
+			b.Id-reg.Height, r.delay)
+	}
+	return nil
+}
+
+// Register the space commitments in b, and revoke the commitments of
+// miners punished in b. Either the whole block applies, or nothing.
+func (r *Registry) Apply(b *Block) error {
+	if b.Id != r.height+1 {
+		return fmt.Errorf("block: registry at %d can't apply block %d", r.height, b.Id)
+	}
+
+	seen := make(map[string]bool)
+	punished := make(map[string]bool)
+	for i := range b.Trans {
+		t := &b.Trans[i]
+		switch t.Type {
+		case SpaceCommit:
+			if t.Commit == nil || len(t.Commit.Pk) == 0 || len(t.Commit.Commit) == 0 {
+				return fmt.Errorf("block: empty commitment in transaction %d", i)
+			}
+			id := string(CommitmentId(t.Commit))
+			if _, ok := r.byId[id]; ok || seen[id] {
+				return fmt.Errorf("block: commitment in transaction %d already registered", i)
+			}
+			seen[id] = true
+		case Punishment:
+			if err := ValidatePunishment(t); err != nil {
+				return fmt.Errorf("%v in transaction %d", err, i)
+			}
+			if t.J > b.Id {
+				return fmt.Errorf("block: transaction %d punishes a future block", i)
+			}
+			if len(r.ByPk(t.Pk)) == 0 || r.Punished(t.Pk) || punished[string(t.Pk)] {
+				return fmt.Errorf("block: nothing to punish in transaction %d", i)
+			}
+			punished[string(t.Pk)] = true
+		}
+	}
+
+	for i := range b.Trans {
+		t := &b.Trans[i]
+		switch t.Type {
+		case SpaceCommit:
+			r.add(&Registered{
+				Commit: *t.Commit,
+				Height: b.Id,
+			})
+		case Punishment:
+			for _, reg := range r.ByPk(t.Pk) {
+				reg.Revoked = b.Id
+			}
+		}
+	}
+	r.height = b.Id
+	return nil
+}
+
+// Undo the most recently applied block, which has to be b
+func (r *Registry) Rollback(b *Block) error {
+	if b.Id != r.height {
+		return errors.New("block: can only roll back the last applied block")
+	}
+	for id, reg := range r.byId {
+		if reg.Height == b.Id {
+			r.remove(id, reg)
+		} else if reg.Revoked == b.Id {
+			reg.Revoked = 0
+		}
+	}
+	r.height--
+	return nil
+}
+
+func (r *Registry) add(reg *Registered) {
+	r.byId[string(CommitmentId(&reg.Commit))] = reg
+	pk := string(reg.Commit.Pk)
+	r.byPk[pk] = append(r.byPk[pk], reg)
+}
+
+func (r *Registry) remove(id string, reg *Registered) {
+	delete(r.byId, id)
+	pk := string(reg.Commit.Pk)
+	regs := r.byPk[pk]
+	for i := range regs {
+		if regs[i] == reg {
+			regs = append(regs[:i], regs[i+1:]...)
+			break
+		}
+	}
+	if len(regs) == 0 {
+		delete(r.byPk, pk)
+	} else {
+		r.byPk[pk] = regs
+	}
+}
+
+func (r *Registry) MarshalBinary() ([]byte, error) {
+	e := new(encoder)
+	e.uint8(registryVersion)
+	e.int(r.delay)
+	e.int(r.height)
+	e.uint32(uint32(len(r.byId)))
+	// sorted by height and id, so the encoding is deterministic
+	ids := make([]string, 0, len(r.byId))
+	for id := range r.byId {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		hi, hj := r.byId[ids[i]].Height, r.byId[ids[j]].Height
+		return hi < hj || (hi == hj && ids[i] < ids[j])
+	})
+	for _, id := range ids {
+		reg := r.byId[id]
+		e.bytes(reg.Commit.Pk)
+		e.bytes(reg.Commit.Commit)
+		e.int(reg.Height)
+		e.int(reg.Revoked)
+	}
+	return e.Bytes(), nil
+}
+
+func (r *Registry) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	if v := d.uint8(); d.err == nil && v != registryVersion {
+		return fmt.Errorf("block: unknown registry version %d", v)
+	}
+	res := NewRegistry(d.int())
+	res.height = d.int()
+	n := d.count(24)
+	for i := 0; i < n && d.err == nil; i++ {
+		reg := new(Registered)
+		reg.Commit.Pk = d.bytes()
+		reg.Commit.Commit = d.bytes()
+		reg.Height = d.int()
+		reg.Revoked = d.int()
+		res.add(reg)
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*r = *res
+	return nil
+}
+
+// Write the registry to fn, replacing it atomically
+func (r *Registry) Save(fn string) error {
+	bin, err := r.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, bin, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Read a registry written by Save
+func LoadRegistry(fn string) (*Registry, error) {
+	bin, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	r := new(Registry)
+	if err := r.UnmarshalBinary(bin); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
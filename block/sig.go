@@ -0,0 +1,109 @@
+package block
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/kwonalbert/spacemint/util"
+	"golang.org/x/crypto/sha3"
+)
+
+// Signature algorithms. An encoded public key starts with one of these.
+const (
+	KeyEd25519 = 1
+	KeyP256    = 2 // ECDSA on P-256, with the point compressed
+)
+
+// Generate a signing key for one of the Key algorithms
+func GenerateKey(alg int) (crypto.Signer, error) {
+	switch alg {
+	case KeyEd25519:
+		_, sk, err := ed25519.GenerateKey(rand.Reader)
+		return sk, err
+	case KeyP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return nil, fmt.Errorf("block: unknown key algorithm %d", alg)
+}
+
+// return: the canonical encoding of pub, as used in commitments and
+//         transactions
+func EncodePublicKey(pub crypto.PublicKey) ([]byte, error) {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return append([]byte{KeyEd25519}, k...), nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			break
+		}
+		return append([]byte{KeyP256}, elliptic.MarshalCompressed(k.Curve, k.X, k.Y)...), nil
+	}
+	return nil, errors.New("block: unsupported public key")
+}
+
+// Decode a public key encoded by EncodePublicKey
+func DecodePublicKey(pk []byte) (crypto.PublicKey, error) {
+	if len(pk) == 0 {
+		return nil, errors.New("block: empty public key")
+	}
+	switch pk[0] {
+	case KeyEd25519:
+		if len(pk) != 1+ed25519.PublicKeySize {
+			return nil, errors.New("block: bad Ed25519 public key")
+		}
+		return ed25519.PublicKey(append([]byte(nil), pk[1:]...)), nil
+	case KeyP256:
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), pk[1:])
+		if x == nil {
+			return nil, errors.New("block: bad P-256 public key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("block: unknown key algorithm %d", pk[0])
+}
+
+// Sign msg with signer
+// Ed25519 signs msg itself; ECDSA signs the hash of msg.
+func Sign(signer crypto.Signer, msg []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	hash := sha3.Sum256(msg)
+	return signer.Sign(rand.Reader, hash[:], crypto.SHA3_256)
+}
+
+// Verify a signature made by Sign, under pk from EncodePublicKey
+func Verify(pk, msg, sig []byte) bool {
+	pub, err := DecodePublicKey(pk)
+	if err != nil {
+		return false
+	}
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, msg, sig)
+	case *ecdsa.PublicKey:
+		hash := sha3.Sum256(msg)
+		return ecdsa.VerifyASN1(k, hash[:], sig)
+	}
+	return false
+}
+
+// Check the signatures of header h, which follows prev, against pk,
+// the key of the commitment h's proof uses: Tsig on the header (see
+// tsigMessage), and Ssig on prev's signatures, which chains the
+// signatures from block to block
+func VerifySignatures(prev, h *Header, pk []byte) error {
+	if !Verify(pk, tsigMessage(h), h.Sig.Tsig) {
+		return errors.New("bad Tsig")
+	}
+	sigBytes := util.Concat([][]byte{prev.Sig.Tsig, prev.Sig.Ssig})
+	if !Verify(pk, sigBytes, h.Sig.Ssig) {
+		return errors.New("bad Ssig")
+	}
+	return nil
+}
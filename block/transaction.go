@@ -1,49 +1,228 @@
 package block
 
 import (
-	"encoding/json"
+	"crypto"
+	"errors"
+	"fmt"
+
 	"github.com/kwonalbert/spacemint/pos"
+	"golang.org/x/crypto/sha3"
 )
 
 const (
 	Payment     = 0
 	SpaceCommit = 1
 	Punishment  = 2
+	Reward      = 3
 )
 
+// Base units in a coin; amounts are counted in base units
+const Coin = 100000000
+
+// version of the transaction encoding; 2 counts coins in base units,
+// 3 pays pk hashes
+const txVersion = 3
+
+// Only the fields of the transaction's type are encoded; the others
+// have to be left empty.
 type Transaction struct {
-	t   int // transaction type
-	tid int // unique transaction identifier
+	Type int // transaction type
 
-	// payment
-	in  *In
-	out *Out
+	// payment; a reward has only Out, and J
+	In  []In
+	Out []Out
 
 	// spacecommit
-	commit *pos.Commitment
+	Commit *pos.Commitment
 
 	// punishment
-	pk  []byte
-	m   []byte
-	j   int
-	sig []byte
+	Pk  []byte    // offender
+	M   [2][]byte // two different messages signed for the same block
+	J   int       // height of the block; also for rewards
+	Sig [2][]byte // offender's signatures on M
 }
 
 type In struct {
-	tid int
-	k   int    // indicating which benefactor
-	sig []byte // signature of (transaction.tid, tid, k, out)
+	Tid []byte // id of the transaction being spent
+	K   int    // indicating which benefactor
+	Pk  []byte // key the spent output pays; see PkHash
+	Sig []byte // signature of the transaction's SigHash
 }
 
 type Out struct {
-	pk    []byte  // recipients pubkey
-	coins float64 // amount of coin given
+	PkHash []byte // hash of the recipient's pubkey; see Address
+	Coins  uint64 // amount given, in base units
+}
+
+// return: the unique identifier of the transaction; the hash of its encoding
+func (t *Transaction) Id() []byte {
+	bin, err := t.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	id := sha3.Sum256(bin)
+	return id[:]
+}
+
+// return: the hash the inputs sign; the id of the transaction with the
+//         input keys and signatures left out, so inputs can be signed
+//         in any order
+func (t *Transaction) SigHash() []byte {
+	u := *t
+	u.In = make([]In, len(t.In))
+	for i := range t.In {
+		u.In[i] = In{Tid: t.In[i].Tid, K: t.In[i].K}
+	}
+	return u.Id()
+}
+
+// Sign the ith input with the key of the output it spends, and put
+// the key in the input
+func (t *Transaction) SignIn(i int, signer crypto.Signer) error {
+	pk, err := EncodePublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	sig, err := Sign(signer, t.SigHash())
+	if err != nil {
+		return err
+	}
+	t.In[i].Pk = pk
+	t.In[i].Sig = sig
+	return nil
 }
 
 func (t *Transaction) MarshalBinary() ([]byte, error) {
-	return json.Marshal(t)
+	if err := t.checkPayload(); err != nil {
+		return nil, err
+	}
+
+	e := new(encoder)
+	e.uint8(txVersion)
+	e.uint8(uint8(t.Type))
+	switch t.Type {
+	case Payment:
+		e.uint32(uint32(len(t.In)))
+		for _, in := range t.In {
+			e.bytes(in.Tid)
+			e.int(in.K)
+			e.bytes(in.Pk)
+			e.bytes(in.Sig)
+		}
+		encodeOuts(e, t.Out)
+	case SpaceCommit:
+		e.bytes(t.Commit.Pk)
+		e.bytes(t.Commit.Commit)
+	case Punishment:
+		e.bytes(t.Pk)
+		e.bytes(t.M[0])
+		e.bytes(t.M[1])
+		e.int(t.J)
+		e.bytes(t.Sig[0])
+		e.bytes(t.Sig[1])
+	case Reward:
+		encodeOuts(e, t.Out)
+		e.int(t.J)
+	}
+	return e.Bytes(), nil
 }
 
-func (t *Transaction) UnmarhsalBinary(data []byte) error {
-	return json.Unmarshal(data, t)
+func encodeOuts(e *encoder, outs []Out) {
+	e.uint32(uint32(len(outs)))
+	for _, out := range outs {
+		e.bytes(out.PkHash)
+		e.uint64(out.Coins)
+	}
+}
+
+// return: the outputs encodeOuts wrote; nil if there are none
+func decodeOuts(d *decoder) []Out {
+	// an output is at least 12 bytes
+	n := d.count(12)
+	if n == 0 {
+		return nil
+	}
+	outs := make([]Out, n)
+	for i := range outs {
+		outs[i].PkHash = d.bytes()
+		outs[i].Coins = d.uint64()
+	}
+	return outs
+}
+
+func (t *Transaction) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	if v := d.uint8(); d.err == nil && v != txVersion {
+		return fmt.Errorf("block: unknown transaction version %d", v)
+	}
+
+	res := Transaction{Type: int(d.uint8())}
+	switch res.Type {
+	case Payment:
+		// an input is at least 20 bytes
+		res.In = make([]In, d.count(20))
+		for i := range res.In {
+			res.In[i].Tid = d.bytes()
+			res.In[i].K = d.int()
+			res.In[i].Pk = d.bytes()
+			res.In[i].Sig = d.bytes()
+		}
+		if len(res.In) == 0 {
+			res.In = nil
+		}
+		res.Out = decodeOuts(d)
+	case SpaceCommit:
+		res.Commit = &pos.Commitment{
+			Pk:     d.bytes(),
+			Commit: d.bytes(),
+		}
+	case Punishment:
+		res.Pk = d.bytes()
+		res.M[0] = d.bytes()
+		res.M[1] = d.bytes()
+		res.J = d.int()
+		res.Sig[0] = d.bytes()
+		res.Sig[1] = d.bytes()
+	case Reward:
+		res.Out = decodeOuts(d)
+		res.J = d.int()
+	default:
+		if d.err == nil {
+			return fmt.Errorf("block: unknown transaction type %d", res.Type)
+		}
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*t = res
+	return nil
+}
+
+// Make sure only the fields of the transaction's type are set
+func (t *Transaction) checkPayload() error {
+	payment := len(t.In) != 0 || len(t.Out) != 0
+	commit := t.Commit != nil
+	offender := len(t.Pk) != 0 ||
+		len(t.M[0]) != 0 || len(t.M[1]) != 0 ||
+		len(t.Sig[0]) != 0 || len(t.Sig[1]) != 0
+	punish := offender || t.J != 0
+
+	var ok bool
+	switch t.Type {
+	case Payment:
+		ok = !commit && !punish
+	case SpaceCommit:
+		ok = commit && !payment && !punish
+	case Punishment:
+		ok = !payment && !commit
+	case Reward:
+		ok = len(t.In) == 0 && !commit && !offender
+	default:
+		return fmt.Errorf("block: unknown transaction type %d", t.Type)
+	}
+	if !ok {
+		return errors.New("block: transaction has fields of another type set")
+	}
+	return nil
 }
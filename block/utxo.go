@@ -0,0 +1,345 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Defines and implements the set of unspent transaction outputs
+
+// Reference to the kth output of transaction tid
+type outpoint struct {
+	tid string
+	k   int
+}
+
+type UTXOSet struct {
+	outs    map[outpoint]Out
+	rewards map[outpoint]bool // the unspent outputs of rewards
+	undo []undo // one entry per recent applied block, most recent last; see Forget
+
+	// new coins a block at height may pay its miner, on top of the
+	// fees; none if nil
+	Issuance func(height int) uint64
+}
+
+// What applying a block changed, so it can be rolled back
+type undo struct {
+	id      int
+	spent   map[outpoint]Out
+	rewards []outpoint // spent outputs that were in rewards
+	created []outpoint
+}
+
+func NewUTXOSet() *UTXOSet {
+	u := UTXOSet{
+		outs:    make(map[outpoint]Out),
+		rewards: make(map[outpoint]bool),
+	}
+	return &u
+}
+
+// return: the kth output of transaction tid, if it is unspent
+func (u *UTXOSet) Get(tid []byte, k int) (Out, bool) {
+	out, ok := u.outs[outpoint{string(tid), k}]
+	return out, ok
+}
+
+// An output that isn't spent yet
+type Unspent struct {
+	Tid []byte // transaction the output is in
+	K   int    // index of the output in the transaction
+	Out
+}
+
+// return: the unspent outputs paying pk hash hash, ordered by
+//         transaction id and index
+func (u *UTXOSet) ByPkHash(hash []byte) []Unspent {
+	var res []Unspent
+	for op, out := range u.outs {
+		if bytes.Equal(out.PkHash, hash) {
+			res = append(res, Unspent{[]byte(op.tid), op.k, out})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		c := bytes.Compare(res[i].Tid, res[j].Tid)
+		return c < 0 || c == 0 && res[i].K < res[j].K
+	})
+	return res
+}
+
+// Check a payment against the unspent outputs
+// return: the fee, i.e. how much the inputs exceed the outputs
+func (u *UTXOSet) Validate(t *Transaction) (uint64, error) {
+	if t.Type != Payment {
+		return 0, errors.New("block: not a payment")
+	}
+	if _, err := t.MarshalBinary(); err != nil {
+		return 0, err
+	}
+	if len(t.In) == 0 {
+		return 0, errors.New("block: payment has no inputs")
+	}
+
+	sigHash := t.SigHash()
+	seen := make(map[outpoint]bool)
+	var in uint64
+	for i := range t.In {
+		op := outpoint{string(t.In[i].Tid), t.In[i].K}
+		if seen[op] {
+			return 0, fmt.Errorf("block: input %d spends an output twice", i)
+		}
+		seen[op] = true
+
+		out, ok := u.outs[op]
+		if !ok {
+			return 0, fmt.Errorf("block: input %d spends a missing or spent output", i)
+		}
+		if !bytes.Equal(PkHash(t.In[i].Pk), out.PkHash) {
+			return 0, fmt.Errorf("block: input %d has the wrong key", i)
+		}
+		if !Verify(t.In[i].Pk, sigHash, t.In[i].Sig) {
+			return 0, fmt.Errorf("block: input %d has a bad signature", i)
+		}
+		if in += out.Coins; in < out.Coins {
+			return 0, errors.New("block: inputs overflow")
+		}
+	}
+
+	out, err := sumOuts(t.Out)
+	if err != nil {
+		return 0, err
+	}
+	if out > in {
+		return 0, errors.New("block: outputs exceed inputs")
+	}
+	return in - out, nil
+}
+
+// return: the total of outs; an error if an amount is zero or the
+//         total overflows
+func sumOuts(outs []Out) (uint64, error) {
+	var sum uint64
+	for i := range outs {
+		c := outs[i].Coins
+		if c == 0 {
+			return 0, fmt.Errorf("block: output %d has an invalid amount", i)
+		}
+		if sum += c; sum < c {
+			return 0, errors.New("block: outputs overflow")
+		}
+	}
+	return sum, nil
+}
+
+// Apply the payments in b, in order, and pay its miner. Either the
+// whole block applies, or the set is left unchanged.
+//
+// The miner is paid by a Reward transaction, which has to come first.
+// It can claim up to the issuance for the block's height plus the
+// fees of the payments, and its outputs can't be spent in the same
+// block. A Punishment takes back the rewards the offender hasn't spent
+// yet; payments after it in the block can't spend them.
+func (u *UTXOSet) Apply(b *Block) error {
+	un, err := u.apply(b)
+	if err != nil {
+		return err
+	}
+	u.undo = append(u.undo, *un)
+	return nil
+}
+
+// return: the fees the payments in ts pay, applied in order after the
+//         last applied block
+func (u *UTXOSet) Fees(ts []Transaction) (uint64, error) {
+	var fees uint64
+	un := undo{spent: make(map[outpoint]Out)}
+	defer u.revert(&un)
+	for i := range ts {
+		if ts[i].Type == Punishment {
+			if err := u.revoke(&ts[i], &un); err != nil {
+				return 0, fmt.Errorf("%v in transaction %d", err, i)
+			}
+		}
+		if ts[i].Type != Payment {
+			continue
+		}
+		fee, err := u.spend(&ts[i], &un)
+		if err != nil {
+			return 0, fmt.Errorf("%v in transaction %d", err, i)
+		}
+		fees += fee
+	}
+	return fees, nil
+}
+
+func (u *UTXOSet) apply(b *Block) (*undo, error) {
+	un := undo{
+		id:    b.Id,
+		spent: make(map[outpoint]Out),
+	}
+	var reward *Transaction
+	var fees uint64
+	for i := range b.Trans {
+		t := &b.Trans[i]
+		if t.Type == Reward {
+			if i != 0 {
+				u.revert(&un)
+				return nil, fmt.Errorf("block: reward in transaction %d; only the first can be", i)
+			}
+			reward = t
+		}
+		if t.Type == Punishment {
+			if err := u.revoke(t, &un); err != nil {
+				u.revert(&un)
+				return nil, fmt.Errorf("%v in transaction %d", err, i)
+			}
+		}
+		if t.Type != Payment {
+			continue
+		}
+		fee, err := u.spend(t, &un)
+		if err != nil {
+			u.revert(&un)
+			return nil, fmt.Errorf("%v in transaction %d", err, i)
+		}
+		// fees are bounded by the coins in existence
+		fees += fee
+	}
+	if reward != nil {
+		if err := u.pay(b, reward, fees, &un); err != nil {
+			u.revert(&un)
+			return nil, fmt.Errorf("%v in transaction 0", err)
+		}
+	}
+	return &un, nil
+}
+
+// Check payment t and apply it, recording the changes in un
+// return: the fee t pays
+func (u *UTXOSet) spend(t *Transaction, un *undo) (uint64, error) {
+	fee, err := u.Validate(t)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, in := range t.In {
+		u.remove(outpoint{string(in.Tid), in.K}, un)
+	}
+	u.create(t, un)
+	return fee, nil
+}
+
+// Remove the unspent rewards of the offender punishment t proves
+func (u *UTXOSet) revoke(t *Transaction, un *undo) error {
+	if err := ValidatePunishment(t); err != nil {
+		return err
+	}
+	hash := PkHash(t.Pk)
+	for op := range u.rewards {
+		if bytes.Equal(u.outs[op].PkHash, hash) {
+			u.remove(op, un)
+		}
+	}
+	return nil
+}
+
+func (u *UTXOSet) remove(op outpoint, un *undo) {
+	un.spent[op] = u.outs[op]
+	delete(u.outs, op)
+	if u.rewards[op] {
+		delete(u.rewards, op)
+		un.rewards = append(un.rewards, op)
+	}
+}
+
+// Check that reward t pays the miner of b at most the issuance and
+// fees, and add its outputs
+func (u *UTXOSet) pay(b *Block, t *Transaction, fees uint64, un *undo) error {
+	if t.J != b.Id {
+		return fmt.Errorf("block: reward for block %d in block %d", t.J, b.Id)
+	}
+	if len(t.Out) == 0 {
+		return errors.New("block: reward has no outputs")
+	}
+	miner := PkHash(b.Proof.Commit.Pk)
+	for i := range t.Out {
+		if !bytes.Equal(t.Out[i].PkHash, miner) {
+			return fmt.Errorf("block: reward output %d doesn't pay the miner", i)
+		}
+	}
+	claim, err := sumOuts(t.Out)
+	if err != nil {
+		return err
+	}
+	var issued uint64
+	if u.Issuance != nil {
+		issued = u.Issuance(b.Id)
+	}
+	limit := issued + fees
+	if limit < issued {
+		limit = math.MaxUint64
+	}
+	if claim > limit {
+		return fmt.Errorf("block: reward claims %d; at most %d", claim, limit)
+	}
+	u.create(t, un)
+	return nil
+}
+
+func (u *UTXOSet) create(t *Transaction, un *undo) {
+	tid := string(t.Id())
+	for k := range t.Out {
+		op := outpoint{tid, k}
+		u.outs[op] = t.Out[k]
+		if t.Type == Reward {
+			u.rewards[op] = true
+		}
+		un.created = append(un.created, op)
+	}
+}
+
+// Undo the most recently applied block, which has to be b
+func (u *UTXOSet) Rollback(b *Block) error {
+	if len(u.undo) == 0 || u.undo[len(u.undo)-1].id != b.Id {
+		return errors.New("block: can only roll back the last applied block")
+	}
+	un := u.undo[len(u.undo)-1]
+	u.undo = u.undo[:len(u.undo)-1]
+	u.revert(&un)
+	return nil
+}
+
+// Forget how to roll back the blocks below height; the chain only
+// rolls back blocks within ReorgWindow of its last block
+func (u *UTXOSet) Forget(height int) {
+	n := 0
+	for n < len(u.undo) && u.undo[n].id < height {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	copy(u.undo, u.undo[n:])
+	for i := len(u.undo) - n; i < len(u.undo); i++ {
+		u.undo[i] = undo{}
+	}
+	u.undo = u.undo[:len(u.undo)-n]
+}
+
+func (u *UTXOSet) revert(un *undo) {
+	// outputs created and spent within the block get deleted again
+	for op, out := range un.spent {
+		u.outs[op] = out
+	}
+	for _, op := range un.rewards {
+		u.rewards[op] = true
+	}
+	for _, op := range un.created {
+		delete(u.outs, op)
+		delete(u.rewards, op)
+	}
+}
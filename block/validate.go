@@ -0,0 +1,181 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/kwonalbert/spacemint/pos"
+	"github.com/kwonalbert/spacemint/util"
+	"golang.org/x/crypto/sha3"
+)
+
+// Rules a block has to follow to extend the chain
+const (
+	RulePrev         = iota // links to the last block
+	RuleHeight              // id is one more than the last block's
+	RuleChallenge           // challenge derives from the chain
+	RuleProof               // proof of space verifies
+	RuleQuality             // quality matches the answer
+	RuleCommitment          // proof uses a registered commitment
+	RuleSignature           // signed by the committed pk
+	RuleTransactions        // transactions apply to the chain
+	RuleSize                // block is small enough
+)
+
+var ruleNames = []string{
+	RulePrev:         "previous hash",
+	RuleHeight:       "height",
+	RuleChallenge:    "challenge",
+	RuleProof:        "proof of space",
+	RuleQuality:      "quality",
+	RuleCommitment:   "commitment",
+	RuleSignature:    "signature",
+	RuleTransactions: "transactions",
+	RuleSize:         "size",
+}
+
+// Returned by ValidateBlock for the first rule a block breaks
+type BlockError struct {
+	Rule int   // one of the Rule constants
+	Err  error // what exactly was wrong
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block: bad %s: %v", ruleNames[e.Rule], e.Err)
+}
+
+func invalid(rule int, err error) error {
+	return &BlockError{Rule: rule, Err: err}
+}
+
+// Check that b can be added to the end of chain
+// return: nil, or a *BlockError for the first rule b breaks
+func ValidateBlock(chain *BlockChain, b *Block) error {
+	if chain.LastBlock < 0 {
+		return errors.New("block: chain has no genesis block")
+	}
+	last, err := chain.Read(chain.LastBlock)
+	if err != nil {
+		return err
+	}
+	challenge, err := GenerateChallenge(chain)
+	if err != nil {
+		return err
+	}
+	if err := checkNext(chain, &last.Header, challenge, b); err != nil {
+		return err
+	}
+	// it was a dry run
+	chain.rollback(b)
+	return nil
+}
+
+// Check that b can follow prev, the last block applied to the UTXO set
+// and registry of chain, answering challenge. If it can, its
+// transactions are left applied.
+func checkNext(chain *BlockChain, prev *Header, challenge []byte, b *Block) error {
+	if err := validateHeader(prev, challenge, &b.Header, &b.Proof, chain.Params); err != nil {
+		return err
+	}
+	if err := chain.Commits.CheckProof(b); err != nil {
+		return invalid(RuleCommitment, err)
+	}
+	if chain.MaxSize > 0 {
+		bin, err := b.MarshalBinary()
+		if err != nil {
+			return invalid(RuleTransactions, err)
+		}
+		if len(bin) > chain.MaxSize {
+			return invalid(RuleSize, fmt.Errorf("%d bytes; at most %d", len(bin), chain.MaxSize))
+		}
+	}
+
+	root, err := TxRoot(b.Trans)
+	if err != nil {
+		return invalid(RuleTransactions, err)
+	}
+	if !bytes.Equal(b.TxRoot, root) {
+		return invalid(RuleTransactions, errors.New("header does not match the transactions"))
+	}
+	if err := chain.apply(b); err != nil {
+		return invalid(RuleTransactions, err)
+	}
+	return nil
+}
+
+// Check the rules a header h and its proof prf follow on their own:
+// h follows prev, prf answers challenge, and h is signed by the miner
+// of prf. Whether prf's commitment is registered is left to the caller.
+func validateHeader(prev *Header, challenge []byte, h *Header, prf *PoS, params *pos.Params) error {
+	if !bytes.Equal(h.Prev, prev.ID()) {
+		return invalid(RulePrev, errors.New("does not link to the last block"))
+	}
+	if h.Id != prev.Id+1 {
+		return invalid(RuleHeight, fmt.Errorf("%d after %d", h.Id, prev.Id))
+	}
+	if !bytes.Equal(prf.Challenge, challenge) {
+		return invalid(RuleChallenge, errors.New("does not match the chain"))
+	}
+	if !bytes.Equal(h.ProofHash, prf.Hash()) {
+		return invalid(RuleProof, errors.New("header does not match the proof"))
+	}
+	if err := VerifyProof(prf, params); err != nil {
+		return invalid(RuleProof, err)
+	}
+	if q := Quality(&prf.Answer); q != h.Quality {
+		return invalid(RuleQuality, fmt.Errorf("claims %v, answer has %v", h.Quality, q))
+	}
+	if err := VerifySignatures(prev, h, prf.Commit.Pk); err != nil {
+		return invalid(RuleSignature, err)
+	}
+	return nil
+}
+
+// Generate the challenge for the next block from older blocks
+// return: challenge for next block []byte
+func GenerateChallenge(chain *BlockChain) ([]byte, error) {
+	if chain.LastBlock < 0 {
+		return nil, errors.New("block: no blocks to derive a challenge from")
+	}
+	return chain.IdAt(challengeBlock(chain.LastBlock, chain.Dist))
+}
+
+// return: the block whose id is the challenge for the block after last;
+//         only headers are needed to derive challenges
+func challengeBlock(last, dist int) int {
+	if last < dist {
+		return last
+	}
+	return last - (dist - 1)
+}
+
+// Verify the answer in prf against its challenge and commitment
+func VerifyProof(prf *PoS, params *pos.Params) error {
+	a := &prf.Answer
+	if a.Size <= 0 || a.Size > pos.MaxIndex {
+		return errors.New("bad graph index")
+	}
+	v := pos.NewVerifier(prf.Commit.Pk, a.Size, params, prf.Commit.Commit)
+	nodes := v.SelectChallenges(prf.Challenge)
+	if !v.VerifySpace(nodes, a.Hashes, a.Parents, a.Proofs, a.PProofs) {
+		return errors.New("answer does not verify")
+	}
+	return nil
+}
+
+// Compute quality of the answer
+// return: quality in float64; 0 for answers of a bad size
+func Quality(a *Answer) float64 {
+	if a.Size <= 0 || a.Size > pos.MaxIndex {
+		return 0
+	}
+	all := util.Concat(a.Hashes)
+	answerHash := sha3.Sum256(all)
+	x := new(big.Float).SetInt(new(big.Int).SetBytes(answerHash[:]))
+	num, _ := util.Root(x, a.Size).Float64()
+	den := math.Exp2(float64(1<<8) / float64(a.Size))
+	return num / den
+}
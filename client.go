@@ -2,21 +2,21 @@ package main
 
 import (
 	"crypto"
-	sign "crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/kwonalbert/spacemint/block"
 	"github.com/kwonalbert/spacemint/pos"
-	"github.com/kwonalbert/spacemint/util"
-	"golang.org/x/crypto/sha3"
+	"github.com/kwonalbert/spacemint/wallet"
 	"log"
 	"math"
-	"math/big"
-	//"net"
+	"net"
 	"net/rpc"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,32 +28,47 @@ type Client struct {
 	dist int              // how far to look back for challenge
 
 	//round
-	sols chan *block.Block // others' blocks
+	sols     chan *block.Block       // others' blocks
+	txs      chan *block.Transaction // transactions sent to us
+	detector *block.Detector         // catches others signing two blocks
+	pool     *block.Mempool          // transactions for our next blocks
 
 	//pos params
 	index    int64
+	params   *pos.Params
 	prover   *pos.Prover
 	verifier *pos.Verifier
 	commit   pos.Commitment
 
 	chain   *block.BlockChain
+	mu      sync.RWMutex // round changes chain under it; the RPCs read under it
 	clients []*rpc.Client
 }
 
-func NewClient(t time.Duration, dist, beta int, index int64, graph string) *Client {
-	sk, err := sign.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		panic(err)
+// Headers served by one GetHeaders call at most
+const maxHeaders = 1000
+
+// Client mining on chain, which was opened with the network's params.
+// It mines with the oldest key of w, which gets the rewards, and
+// adds a key to w if it has none.
+func NewClient(net *block.ChainParams, index int64, graph pos.Storage, chain *block.BlockChain, w *wallet.Wallet) *Client {
+	t, dist, params := net.BlockTime, net.Dist, &net.PoS
+	if len(w.Keys()) == 0 {
+		if _, err := w.NewKey(block.KeyEd25519); err != nil {
+			panic(err)
+		}
 	}
+	pkBytes := w.Keys()[0]
+	sk, _ := w.Signer(pkBytes)
 	pk := sk.Public()
-	pkBytes, err := json.Marshal(pk)
-	if err != nil {
-		panic(err)
-	}
 
-	prover := pos.NewProver(pkBytes, index, "Xi", graph)
+	prover := pos.NewProverStorage(pkBytes, index, "Xi", graph, params)
 	commit := prover.Init()
-	verifier := pos.NewVerifier(pkBytes, index, beta, commit.Commit)
+	verifier := pos.NewVerifier(pkBytes, index, params, commit.Commit)
+	if _, ok := chain.Commits.ById(block.CommitmentId(commit)); !ok {
+		log.Printf("Commitment %x:%x is not registered, so it can't mine; "+
+			"on regtest, register it in genesis with -commit", commit.Pk, commit.Commit)
+	}
 
 	c := Client{
 		sk:   sk,
@@ -61,18 +76,29 @@ func NewClient(t time.Duration, dist, beta int, index int64, graph string) *Clie
 		t:    t,
 		dist: dist,
 
-		sols: make(chan *block.Block, 100), // nomially say 100 answers per round..
+		sols:     make(chan *block.Block, 100), // nomially say 100 answers per round..
+		txs:      make(chan *block.Transaction, 1000),
+		detector: block.NewDetector(),
+		pool:     block.NewMempool(chain),
 
 		index:    index,
+		params:   params,
 		prover:   prover,
 		verifier: verifier,
 		commit:   *commit,
+
+		chain: chain,
 	}
+	c.detector.Chain = chain
+	chain.OnReorg(func(r *block.Reorg) {
+		log.Printf("Switched to a fork from block %d: %d blocks out, %d in",
+			r.Fork, len(r.Removed), len(r.Added))
+	})
 	return &c
 }
 
 func (c *Client) Sign(msg []byte) ([]byte, error) {
-	return c.sk.Sign(rand.Reader, msg, crypto.SHA3_256)
+	return block.Sign(c.sk, msg)
 }
 
 func (c *Client) Mine(challenge []byte) *block.PoS {
@@ -89,95 +115,594 @@ func (c *Client) Mine(challenge []byte) *block.PoS {
 		Commit:    c.commit,
 		Challenge: challenge,
 		Answer:    a,
-		Quality:   c.Quality(challenge, a),
 	}
 
 	return &p
 }
 
-// Compute quality of the answer. Also builds a verifier
-// return: quality in float64
-func (c *Client) Quality(challenge []byte, a block.Answer) float64 {
-	nodes := c.verifier.SelectChallenges(challenge)
-	if !c.verifier.VerifySpace(nodes, a.Hashes, a.Parents, a.Proofs, a.PProofs) {
-		return -1
+// Runs a round of the protocol
+// Mines and sends out a block, then waits for the others' blocks.
+// The valid block of best quality extends the chain, possibly
+// switching it to a fork.
+func (c *Client) round() {
+	// blocks this deep can't be replaced, so their miners aren't punished
+	c.detector.Forget(c.chain.LastBlock - block.ReorgWindow)
+	challenge, err := block.GenerateChallenge(c.chain)
+	if err != nil {
+		panic(err)
+	}
+	prf := c.Mine(challenge)
+
+	old, err := c.chain.Read(c.chain.LastBlock)
+	if err != nil {
+		panic(err)
+	}
+	// fill what the block has room for from the pool
+	limit := math.MaxInt32
+	if c.chain.MaxSize > 0 {
+		bin, err := block.NewBlock(old, *prf, nil, c.sk).MarshalBinary()
+		if err != nil {
+			panic(err)
+		}
+		limit = c.chain.MaxSize - len(bin)
+	}
+	ts, err := c.pool.Template(c.commit.Pk, limit)
+	if err != nil {
+		panic(err)
+	}
+	ours := block.NewBlock(old, *prf, ts, c.sk)
+	for _, r := range c.clients {
+		err := r.Call("Client.SendBlock", ours, nil)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if err := c.insert(ours); err != nil {
+		panic(err)
+	}
+	// blocks from this round compete with ours; Insert keeps the best
+	timeout := time.After(c.t)
+	for waiting := true; waiting; {
+		select {
+		case b := <-c.sols:
+			if t := c.detector.Observe(b); t != nil {
+				c.accept(t)
+			}
+			if err := c.insert(b); err != nil {
+				log.Println("Rejected block:", err)
+			}
+		case t := <-c.txs:
+			c.accept(t)
+		case <-timeout:
+			waiting = false
+		}
 	}
+}
 
-	all := util.Concat(a.Hashes)
-	answerHash := sha3.Sum256(all)
-	x := new(big.Float).SetInt(new(big.Int).SetBytes(answerHash[:]))
-	num, _ := util.Root(x, a.Size).Float64()
-	den := math.Exp2(float64(1<<8) / float64(a.Size))
-	return num / den
+// Insert b into the chain, while no RPC reads it
+func (c *Client) insert(b *block.Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.chain.Insert(b)
 }
 
-// Generate challenge from older blocks
-// return: challenge for next block []byte
-func (c *Client) GenerateChallenge() []byte {
-	var b *block.Block
-	var err error
-	if c.chain.LastBlock < c.dist {
-		b, err = c.chain.Read(c.chain.LastBlock)
-	} else {
-		b, err = c.chain.Read(c.chain.LastBlock - (c.dist - 1))
+// Add t to the pool, and pass it on to the others if it is new
+func (c *Client) accept(t *block.Transaction) {
+	if c.pool.Has(t.Id()) {
+		return
+	}
+	if err := c.pool.Accept(t); err != nil {
+		log.Println("Rejected transaction:", err)
+		return
 	}
+	for _, r := range c.clients {
+		r.Go("Client.SendTx", t, nil, nil)
+	}
+}
+
+// Coins, in base units, that the chain holds for address addr. Chains
+// opened without network params take mainnet addresses.
+func (c *Client) GetBalance(addr string, coins *uint64) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	net := c.chain.Net
+	if net == nil {
+		net = &block.MainnetParams
+	}
+	hash, err := net.DecodeAddress(addr)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	*coins = 0
+	for _, out := range c.chain.UTXO.ByPkHash(hash) {
+		*coins += out.Coins
+	}
+	return nil
+}
+
+func (c *Client) SendTx(t *block.Transaction, _ *struct{}) error {
+	if _, err := t.MarshalBinary(); err != nil {
+		return err
 	}
-	bin, err := b.MarshalBinary()
+	c.txs <- t
+	return nil
+}
+
+func (c *Client) SendBlock(b *block.Block, _ *struct{}) error {
+	c.sols <- b
+	return nil
+}
+
+// What a node can serve its peers
+type NodeInfo struct {
+	LastBlock int
+	Archival  bool // keeps the proofs of all blocks
+	PrunedTo  int  // last block whose proof is gone; 0 if none
+}
+
+// Tells peers and light clients which blocks the node has proofs for
+func (c *Client) GetInfo(_ struct{}, info *NodeInfo) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	*info = NodeInfo{
+		LastBlock: c.chain.LastBlock,
+		Archival:  c.chain.Archival(),
+		PrunedTo:  c.chain.PrunedTo(),
+	}
+	return nil
+}
+
+// Blocks a light client asks for, by height
+type HeaderRange struct {
+	From, To int
+}
+
+// Serves headers with their proofs to light clients
+func (c *Client) GetHeaders(r *HeaderRange, phs *[]block.ProvenHeader) error {
+	if r.To < r.From || r.To-r.From >= maxHeaders {
+		return fmt.Errorf("headers %d to %d: ask for 1 to %d at a time", r.From, r.To, maxHeaders)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	res, err := c.chain.Headers(r.From, r.To)
+	*phs = res
+	return err
+}
+
+// Serves proofs that a transaction is in the chain to light clients
+func (c *Client) GetTxProof(tid []byte, p *block.TxProof) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	res, err := c.chain.ProveTx(tid)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	challenge := sha3.Sum256(bin)
-	return challenge[:]
+	*p = *res
+	return nil
 }
 
-// Runs a round of the protocol
-func (c *Client) round() {
-	challenge := c.GenerateChallenge()
-	prf := c.Mine(challenge)
+// Serve the RPCs on addr, and connect to the peers at the comma
+// separated addresses, waiting for the ones that aren't up yet
+func (c *Client) serve(addr, peers string) error {
+	srv := rpc.NewServer()
+	if err := srv.Register(c); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go srv.Accept(l)
+	for _, p := range strings.Split(peers, ",") {
+		if p == "" {
+			continue
+		}
+		r, err := rpc.Dial("tcp", p)
+		for i := 0; err != nil && i < 30; i++ {
+			time.Sleep(time.Second)
+			r, err = rpc.Dial("tcp", p)
+		}
+		if err != nil {
+			return err
+		}
+		c.clients = append(c.clients, r)
+	}
+	return nil
+}
 
-	send := true
+// Machine readable result of benchmarking one plot
+type benchResult struct {
+	Index       int64   `json:"index"`
+	Nodes       int64   `json:"nodes"`
+	PlotBytes   int64   `json:"plot_bytes"`
+	GenSecs     float64 `json:"gen_secs"`
+	CommitSecs  float64 `json:"commit_secs"`
+	NodesPerSec float64 `json:"nodes_per_sec"` // graph generation
+	MBPerSec    float64 `json:"mb_per_sec"`    // graph generation
+	Challenges  int     `json:"challenges"`
+	ProofBytes  int     `json:"proof_bytes"`
+	ProveSecs   float64 `json:"prove_secs"`
+	VerifySecs  float64 `json:"verify_secs"`
+}
 
-	for {
-		select {
-		case b := <-c.sols:
-			// probably can't trust the others in final version..
-			if b.Hash.Proof.Quality > prf.Quality {
-				send = false
-				break
-			}
-		default:
-			break
+// Generate, commit, prove and verify a fresh plot in db
+func bench(pk []byte, index int64, name string, db pos.Storage, params *pos.Params) *benchResult {
+	res := &benchResult{
+		Index: index,
+		Nodes: pos.NumNodes(index),
+	}
+
+	now := time.Now()
+	prover := pos.NewProverStorage(pk, index, name, db, params)
+	res.GenSecs = time.Since(now).Seconds()
+	res.NodesPerSec = float64(res.Nodes) / res.GenSecs
+	res.MBPerSec = float64(res.Nodes*pos.NodeSize) / res.GenSecs / 1e6
+
+	now = time.Now()
+	commit := prover.Init()
+	res.CommitSecs = time.Since(now).Seconds()
+
+	size, err := db.Size()
+	if err != nil {
+		log.Fatal(err)
+	}
+	res.PlotBytes = size
+
+	verifier := pos.NewVerifier(pk, index, params, commit.Commit)
+	seed := make([]byte, 64)
+	rand.Read(seed)
+	cs := verifier.SelectChallenges(seed)
+	res.Challenges = len(cs)
+
+	now = time.Now()
+	hashes, parents, proofs, pProofs := prover.ProveSpace(cs)
+	res.ProveSecs = time.Since(now).Seconds()
+	res.ProofBytes = pos.ProofSize(hashes, parents, proofs, pProofs)
+
+	now = time.Now()
+	if !verifier.VerifySpace(cs, hashes, parents, proofs, pProofs) {
+		log.Fatal("Verify space failed:", cs)
+	}
+	res.VerifySecs = time.Since(now).Seconds()
+	return res
+}
+
+// Open the wallet in fn, or create it with a key if there is none
+func openWallet(fn string) (*wallet.Wallet, error) {
+	pass := []byte(os.Getenv("SPACEMINT_PASSPHRASE"))
+	if _, err := os.Stat(fn); err == nil {
+		return wallet.Open(fn, pass)
+	}
+	if len(pass) == 0 {
+		return nil, fmt.Errorf("set $SPACEMINT_PASSPHRASE to create the wallet %s", fn)
+	}
+	w, err := wallet.Create(fn, pass)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.NewKey(block.KeyEd25519)
+	return w, err
+}
+
+// Print the addresses of the wallet in fn, with their coins on the chain
+// in chainFn, and the wallet's history
+func showWallet(fn, chainFn string, net *block.ChainParams) error {
+	w, err := openWallet(fn)
+	if err != nil {
+		return err
+	}
+	chain, err := block.OpenChain(chainFn, net)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+
+	for _, pk := range w.Keys() {
+		var sum uint64
+		for _, out := range chain.UTXO.ByPkHash(block.PkHash(pk)) {
+			sum += out.Coins
+		}
+		fmt.Printf("%s %d\n", net.Address(pk), sum)
+	}
+	hist, err := w.History(chain)
+	if err != nil {
+		return err
+	}
+	for _, e := range hist {
+		fmt.Printf("block %d tx %x +%d -%d\n", e.Height, e.Tid, e.Received, e.Spent)
+	}
+	fmt.Printf("balance %d\n", w.Balance(chain.UTXO))
+	return nil
+}
+
+// Export the chain in chainFn to fn, as JSON if asJSON
+func exportChain(chainFn, fn string, asJSON bool, net *block.ChainParams) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	var n int
+	if asJSON {
+		n, err = block.ExportJSON(chainFn, f)
+	} else {
+		n, err = block.ExportChain(chainFn, net, f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d blocks exported to %s\n", n, fn)
+	return nil
+}
+
+// Import the export in fn to the chain in chainFn, after the blocks
+// it already has
+func importChain(chainFn, fn string, net *block.ChainParams) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	chain, err := block.OpenChain(chainFn, net)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	n, err := block.ImportChain(chain, f)
+	fmt.Printf("%d blocks imported; the chain ends at block %d\n", n, chain.LastBlock)
+	return err
+}
+
+// Sync the headers of network net from the node at addr, and check
+// that the transaction with id tid, if any, is in them
+func lightSync(addr string, tid []byte, net *block.ChainParams) error {
+	r, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var info NodeInfo
+	if err := r.Call("Client.GetInfo", struct{}{}, &info); err != nil {
+		return err
+	}
+	if info.PrunedTo > 0 {
+		return fmt.Errorf("%s pruned the proofs up to block %d; sync from an archival node", addr, info.PrunedTo)
+	}
+	lc := block.NewLightChain(net)
+	for lc.LastBlock < info.LastBlock {
+		to := lc.LastBlock + maxHeaders
+		if to > info.LastBlock {
+			to = info.LastBlock
+		}
+		var phs []block.ProvenHeader
+		if err := r.Call("Client.GetHeaders", &HeaderRange{lc.LastBlock + 1, to}, &phs); err != nil {
+			return err
+		}
+		if _, err := lc.Sync(phs); err != nil {
+			return err
 		}
 	}
-	if send {
-		old, err := c.chain.Read(c.chain.LastBlock)
+	fmt.Printf("headers synced up to block %d\n", lc.LastBlock)
+	if tid == nil {
+		return nil
+	}
+	var p block.TxProof
+	if err := r.Call("Client.GetTxProof", tid, &p); err != nil {
+		return err
+	}
+	conf, err := lc.VerifyTx(&p)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("transaction %x has %d confirmations\n", tid, conf)
+	return nil
+}
+
+// Parse commitments given as comma separated pk:root, in hex
+func parseCommits(s string) ([]pos.Commitment, error) {
+	var res []pos.Commitment
+	for _, f := range strings.Split(s, ",") {
+		if f == "" {
+			continue
+		}
+		parts := strings.Split(f, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad commitment %q; want pk:root", f)
+		}
+		pk, err := hex.DecodeString(parts[0])
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		// TODO: where do transactions come from??
-		b := block.NewBlock(old, *prf, nil, c.sk)
-		for _, r := range c.clients {
-			err := r.Call("Client.SendBlock", b, nil)
-			if err != nil {
-				panic(err)
-			}
+		root, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(pk) == 0 || len(root) == 0 {
+			return nil, fmt.Errorf("bad commitment %q; want pk:root", f)
 		}
+		res = append(res, pos.Commitment{Pk: pk, Commit: root})
 	}
+	return res, nil
+}
+
+// Open the graph storage; a comma separated list of files is striped
+func openPlot(files string, stripe int64) (pos.Storage, error) {
+	fns := strings.Split(files, ",")
+	if len(fns) == 1 {
+		return pos.OpenFile(fns[0])
+	}
+	return pos.OpenSharded(fns, stripe)
 }
 
 func main() {
 	idx := flag.Int("index", 1, "graph index")
 	name := flag.String("name", "Xi", "graph name")
-	dir := flag.String("file", "/media/storage/Xi", "graph location")
-	mode := flag.String("mode", "gen", "mode:[gen|commit]")
+	dir := flag.String("file", "/media/storage/Xi", "graph location; comma separated files stripe the graph")
+	stripe := flag.Int64("stripe", 1<<20, "stripe size in bytes when the graph spans several files")
+	mode := flag.String("mode", "gen", "mode:[gen|commit|check|bench|scan|repair|wallet|prune|export|import|register|node|light]")
+	chainFile := flag.String("chain", "spacemint.chain", "block chain file for scan, repair, wallet, prune, export, import and node")
+	exportFile := flag.String("export", "spacemint.export", "chain export file for export and import")
+	asJSON := flag.Bool("json", false, "export the chain as JSON, one block per line; it can't be imported")
+	prune := flag.Int("prune", 0, "keep the proofs of only this many last blocks; 0 keeps all")
+	walletFile := flag.String("wallet", "spacemint.wallet", "wallet file; the passphrase is taken from $SPACEMINT_PASSPHRASE")
+	network := flag.String("net", "mainnet", "network:[mainnet|regtest]")
+	commits := flag.String("commit", "", "regtest only: commitments to register in the genesis block instead of the preset ones, as comma separated pk:root in hex, e.g. from register mode; every node of the network needs the same")
+	preset := flag.String("params", "", "pos params preset:[default|test]; defaults to the network's")
+	soundness := flag.Float64("soundness", 0, "target soundness error; overrides -params")
+	fraction := flag.Float64("fraction", 0.5, "assumed fraction of the graph a cheater stores")
+	listen := flag.String("listen", ":7700", "address node mode serves peers and light clients on")
+	peers := flag.String("peers", "", "comma separated addresses of the peers a node sends blocks to; light mode syncs from the first")
+	txId := flag.String("tx", "", "id, in hex, of a transaction light mode checks is in the chain")
 	flag.Parse()
 
+	net, err := block.ChainPreset(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cs, err := parseCommits(*commits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(cs) > 0 {
+		if net.Name != block.RegtestParams.Name {
+			log.Fatal("-commit only overrides the genesis commitments of regtest")
+		}
+		net.Commits = cs
+	}
+	params := &net.PoS
+	if *soundness > 0 {
+		params, err = pos.NewParams(*soundness, *fraction)
+	} else if *preset != "" {
+		params, err = pos.Preset(*preset)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if (*mode == "register" || *mode == "node") && (*soundness > 0 || *preset != "") {
+		log.Fatalf("%s mode uses the pos params of the network; -params and -soundness don't apply", *mode)
+	}
+
+	if *mode == "scan" || *mode == "repair" {
+		var rep *block.ScanReport
+		if *mode == "scan" {
+			rep, err = block.ScanChain(*chainFile)
+		} else {
+			rep, err = block.RepairChain(*chainFile)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%d good blocks in %d bytes\n", len(rep.Ends), rep.Size)
+		for _, c := range rep.Corrupt {
+			fmt.Println("corrupt", c)
+		}
+		return
+	}
+
+	if *mode == "prune" {
+		chain, err := block.OpenChain(*chainFile, net)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer chain.Close()
+		chain.PruneDepth = *prune
+		if err := chain.PruneAnswers(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("proofs pruned up to block %d of %d\n", chain.PrunedTo(), chain.LastBlock)
+		return
+	}
+
+	if *mode == "export" {
+		if err := exportChain(*chainFile, *exportFile, *asJSON, net); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *mode == "import" {
+		if err := importChain(*chainFile, *exportFile, net); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *mode == "wallet" {
+		if err := showWallet(*walletFile, *chainFile, net); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *mode == "light" {
+		var tid []byte
+		if *txId != "" {
+			if tid, err = hex.DecodeString(*txId); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := lightSync(strings.Split(*peers, ",")[0], tid, net); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	pk := []byte{1}
-	beta := 30
+	if *mode == "bench" {
+		for _, fn := range strings.Split(*dir, ",") {
+			os.Remove(fn)
+		}
+	}
+	db, err := openPlot(*dir, *stripe)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if *mode == "register" {
+		// the commitment NewClient mines with, for -commit
+		w, err := openWallet(*walletFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prover := pos.NewProverStorage(w.Keys()[0], int64(*idx), *name, db, &net.PoS)
+		commit := prover.Init()
+		fmt.Printf("%x:%x\n", commit.Pk, commit.Commit)
+		return
+	}
+
+	if *mode == "node" {
+		w, err := openWallet(*walletFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chain, err := block.OpenChain(*chainFile, net)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer chain.Close()
+		chain.PruneDepth = *prune
+		c := NewClient(net, int64(*idx), db, chain, w)
+		if err := c.serve(*listen, *peers); err != nil {
+			log.Fatal(err)
+		}
+		for {
+			c.round()
+		}
+	}
+
+	if *mode == "bench" {
+		res := bench(pk, int64(*idx), *name, db, params)
+		if err := json.NewEncoder(os.Stdout).Encode(res); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	now := time.Now()
-	prover := pos.NewProver(pk, int64(*idx), *name, *dir)
+	prover := pos.NewProverStorage(pk, int64(*idx), *name, db, params)
 	if *mode == "gen" {
 		fmt.Printf("%d. Graph gen: %fs\n", *idx, time.Since(now).Seconds())
 	} else if *mode == "commit" {
@@ -187,7 +712,7 @@ func main() {
 	} else if *mode == "check" {
 		commit := prover.PreInit()
 		root := commit.Commit
-		verifier := pos.NewVerifier(pk, int64(*idx), beta, root)
+		verifier := pos.NewVerifier(pk, int64(*idx), params, root)
 
 		seed := make([]byte, 64)
 		rand.Read(seed)
@@ -0,0 +1,121 @@
+package pos
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var benchIndex = flag.Int("benchindex", 6, "largest graph index to benchmark")
+
+// Run f as a sub-benchmark for every index up to -benchindex
+func forIndexes(b *testing.B, f func(b *testing.B, index int64, fn string)) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := int64(1); i <= int64(*benchIndex); i++ {
+		fn := filepath.Join(dir, fmt.Sprintf("%s%d", graphDir, i))
+		b.Run(fmt.Sprintf("index=%d", i), func(b *testing.B) {
+			f(b, i, fn)
+		})
+	}
+}
+
+// Report throughput in nodes per second along with MB/s, over the time
+// the timer ran
+func reportNodes(b *testing.B, nodes int64) {
+	secs := b.Elapsed().Seconds()
+	b.ReportMetric(float64(nodes)*float64(b.N)/secs, "nodes/s")
+	b.SetBytes(nodes * NodeSize)
+}
+
+// Prover with a generated and committed graph
+func benchProver(b *testing.B, index int64, fn string) (*Prover, *Verifier) {
+	p := NewProver(pk, index, name, fn, params)
+	commit := p.Init()
+	v := NewVerifier(pk, index, params, commit.Commit)
+	b.ResetTimer()
+	return p, v
+}
+
+func BenchmarkGraph(b *testing.B) {
+	forIndexes(b, func(b *testing.B, index int64, fn string) {
+		size, pow2, log2 := dims(index)
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			os.Remove(fn)
+			b.StartTimer()
+			g := NewGraph(index, size, pow2, log2, fn, pk, params)
+			g.Close()
+		}
+		reportNodes(b, size)
+	})
+}
+
+func BenchmarkCommit(b *testing.B) {
+	forIndexes(b, func(b *testing.B, index int64, fn string) {
+		p := NewProver(pk, index, name, fn, params)
+		defer p.graph.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			p.Init()
+		}
+		reportNodes(b, p.size)
+	})
+}
+
+func BenchmarkOpen(b *testing.B) {
+	forIndexes(b, func(b *testing.B, index int64, fn string) {
+		p, _ := benchProver(b, index, fn)
+		defer p.graph.Close()
+		for i := 0; i < b.N; i++ {
+			p.Open(int64(i) % p.size)
+		}
+	})
+}
+
+func BenchmarkSelectChallenges(b *testing.B) {
+	forIndexes(b, func(b *testing.B, index int64, fn string) {
+		p, v := benchProver(b, index, fn)
+		defer p.graph.Close()
+		seed := []byte("seed")
+		for i := 0; i < b.N; i++ {
+			v.SelectChallenges(seed)
+		}
+	})
+}
+
+func BenchmarkProveSpace(b *testing.B) {
+	forIndexes(b, func(b *testing.B, index int64, fn string) {
+		p, v := benchProver(b, index, fn)
+		defer p.graph.Close()
+		cs := v.SelectChallenges([]byte("seed"))
+		b.ResetTimer()
+		size := 0
+		for i := 0; i < b.N; i++ {
+			size = ProofSize(p.ProveSpace(cs))
+		}
+		b.ReportMetric(float64(size), "proof-bytes")
+	})
+}
+
+func BenchmarkVerifySpace(b *testing.B) {
+	forIndexes(b, func(b *testing.B, index int64, fn string) {
+		p, v := benchProver(b, index, fn)
+		defer p.graph.Close()
+		cs := v.SelectChallenges([]byte("seed"))
+		hashes, parents, proofs, pProofs := p.ProveSpace(cs)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if !v.VerifySpace(cs, hashes, parents, proofs, pProofs) {
+				b.Fatal("Verify space failed:", cs)
+			}
+		}
+	})
+}
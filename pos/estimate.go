@@ -0,0 +1,58 @@
+package pos
+
+// Costs of a proof of space, derived from the parameters alone
+type Estimate struct {
+	Challenges   int   // challenges per proof
+	ProofSize    int64 // bytes in the largest possible proof
+	VerifyHashes int64 // hash evaluations to verify the largest proof
+	PlotSize     int64 // bytes on disk for the labels and merkle tree
+}
+
+// Estimate the costs for the graph of index without generating it.
+// The exact proof size depends on how many parents the challenged nodes
+// have; ProofSize and VerifyHashes give the exact values for a challenge set.
+func (p *Params) Estimate(index int64) *Estimate {
+	_, pow2, log2 := dims(index)
+	n := int64(p.Challenges(index))
+	return &Estimate{
+		Challenges:   int(n),
+		ProofSize:    n * 3 * (1 + log2) * hashSize,
+		VerifyHashes: n * (1 + 3*log2),
+		PlotSize:     2 * pow2 * NodeSize,
+	}
+}
+
+// return: number of bytes in the proof for challenges on the graph of index
+func (p *Params) ProofSize(index int64, challenges []int64) int64 {
+	_, _, log2 := dims(index)
+	var size int64
+	for _, np := range p.numParents(index, challenges) {
+		// a label and its merkle path for the node and each parent
+		size += (1 + np) * (1 + log2) * hashSize
+	}
+	return size
+}
+
+// return: number of hash evaluations to verify the proof for challenges
+//         on the graph of index
+func (p *Params) VerifyHashes(index int64, challenges []int64) int64 {
+	_, _, log2 := dims(index)
+	var count int64
+	for _, np := range p.numParents(index, challenges) {
+		// recompute the label, then walk the merkle paths
+		count += 1 + (1+np)*log2
+	}
+	return count
+}
+
+func (p *Params) numParents(index int64, challenges []int64) []int64 {
+	g := &Graph{
+		index:  index,
+		params: p,
+	}
+	res := make([]int64, len(challenges))
+	for i := range challenges {
+		res[i] = int64(len(g.GetParents(challenges[i], index)))
+	}
+	return res
+}
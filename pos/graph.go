@@ -4,21 +4,20 @@ import (
 	"encoding/binary"
 	//"fmt"
 	"github.com/kwonalbert/spacemint/util"
-	"golang.org/x/crypto/sha3"
-	"os"
 	//"runtime/pprof"
 )
 
-const nodeSize = hashSize
+// Bytes a node of the graph takes in storage
+const NodeSize = hashSize
 
 type Graph struct {
-	pk    []byte
-	fn    string
-	db    *os.File
-	index int64
-	log2  int64
-	pow2  int64
-	size  int64
+	pk     []byte
+	db     Storage
+	index  int64
+	log2   int64
+	pow2   int64
+	size   int64
+	params *Params
 }
 
 type Node struct {
@@ -34,37 +33,35 @@ func (n *Node) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
-// Generate a new PoS graph of index
+// Generate a new PoS graph of index in the file fn
 // Currently only supports the weaker PoS graph
 // Note that this graph will have O(2^index) nodes
-func NewGraph(index, size, pow2, log2 int64, fn string, pk []byte) *Graph {
-
-	var db *os.File
-	_, err := os.Stat(fn)
-	fileExists := err == nil
-	if fileExists { //file exists
-		db, err = os.OpenFile(fn, os.O_RDWR, 0666)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		db, err = os.Create(fn)
-		if err != nil {
-			panic(err)
-		}
+func NewGraph(index, size, pow2, log2 int64, fn string, pk []byte, params *Params) *Graph {
+	db, err := OpenFile(fn)
+	if err != nil {
+		panic(err)
+	}
+	return NewGraphStorage(index, size, pow2, log2, db, pk, params)
+}
+
+// Generate a new PoS graph of index in db, unless db already holds one
+func NewGraphStorage(index, size, pow2, log2 int64, db Storage, pk []byte, params *Params) *Graph {
+	stored, err := db.Size()
+	if err != nil {
+		panic(err)
 	}
 
 	g := &Graph{
-		pk:    pk,
-		fn:    fn,
-		db:    db,
-		index: index,
-		log2:  log2,
-		size:  size,
-		pow2:  pow2,
+		pk:     pk,
+		db:     db,
+		index:  index,
+		log2:   log2,
+		size:   size,
+		pow2:   pow2,
+		params: params,
 	}
 
-	if !fileExists {
+	if stored == 0 {
 		g.XiGraphIter(index)
 	}
 
@@ -182,9 +179,9 @@ func (g *Graph) NewNode(id int64, hash []byte) {
 func (g *Graph) GetId(id int64) *Node {
 	//fmt.Println("read id", id)
 	node := new(Node)
-	data := make([]byte, nodeSize)
-	num, err := g.db.ReadAt(data, id*nodeSize)
-	if err != nil || num != nodeSize {
+	data := make([]byte, NodeSize)
+	num, err := g.db.ReadAt(data, id*NodeSize)
+	if err != nil || num != NodeSize {
 		panic(err)
 	}
 	node.H = data
@@ -193,8 +190,8 @@ func (g *Graph) GetId(id int64) *Node {
 
 func (g *Graph) WriteId(node *Node, id int64) {
 	//fmt.Println("write id", id)
-	num, err := g.db.WriteAt(node.H, id*nodeSize)
-	if err != nil || num != nodeSize {
+	num, err := g.db.WriteAt(node.H, id*NodeSize)
+	if err != nil || num != NodeSize {
 		panic(err)
 	}
 }
@@ -239,6 +236,11 @@ func (g *Graph) bfsToPost(node int64) int64 {
 	return res
 }
 
+// return: number of nodes in the graph of index
+func NumNodes(index int64) int64 {
+	return numXi(index)
+}
+
 func numXi(index int64) int64 {
 	return (1 << uint64(index)) * (index + 1) * index
 }
@@ -276,9 +278,9 @@ func (g *Graph) ButterflyGraph(index int64, count *int64) {
 			binary.PutVarint(buf, *count)
 			val := append(g.pk, buf...)
 			val = append(val, ph...)
-			hash := sha3.Sum256(val)
+			hash := g.params.sum(val)
 
-			g.NewNode(*count, hash[:])
+			g.NewNode(*count, hash)
 			*count++
 		}
 	}
@@ -298,9 +300,9 @@ func (g *Graph) XiGraphIter(index int64) {
 		buf := make([]byte, hashSize)
 		binary.PutVarint(buf, count)
 		val := append(g.pk, buf...)
-		hash := sha3.Sum256(val)
+		hash := g.params.sum(val)
 
-		g.NewNode(count, hash[:])
+		g.NewNode(count, hash)
 		count++
 	}
 
@@ -332,9 +334,9 @@ func (g *Graph) XiGraphIter(index int64) {
 				binary.PutVarint(buf, count)
 				val := append(g.pk, buf...)
 				val = append(val, ph...)
-				hash := sha3.Sum256(val)
+				hash := g.params.sum(val)
 
-				g.NewNode(count, hash[:])
+				g.NewNode(count, hash)
 				count++
 			}
 		} else if graph == 1 {
@@ -349,9 +351,9 @@ func (g *Graph) XiGraphIter(index int64) {
 				binary.PutVarint(buf, nodeId)
 				val := append(g.pk, buf...)
 				val = append(val, parent.H...)
-				hash := sha3.Sum256(val)
+				hash := g.params.sum(val)
 
-				g.NewNode(nodeId, hash[:])
+				g.NewNode(nodeId, hash)
 				count++
 			}
 		} else if graph == 2 {
@@ -365,9 +367,9 @@ func (g *Graph) XiGraphIter(index int64) {
 				binary.PutVarint(buf, nodeId)
 				val := append(g.pk, buf...)
 				val = append(val, parent.H...)
-				hash := sha3.Sum256(val)
+				hash := g.params.sum(val)
 
-				g.NewNode(nodeId, hash[:])
+				g.NewNode(nodeId, hash)
 				count++
 			}
 		} else if graph == 3 {
@@ -381,9 +383,9 @@ func (g *Graph) XiGraphIter(index int64) {
 				binary.PutVarint(buf, nodeId)
 				val := append(g.pk, buf...)
 				val = append(val, parent.H...)
-				hash := sha3.Sum256(val)
+				hash := g.params.sum(val)
 
-				g.NewNode(nodeId, hash[:])
+				g.NewNode(nodeId, hash)
 				count++
 			}
 		} else {
@@ -401,16 +403,16 @@ func (g *Graph) XiGraphIter(index int64) {
 				binary.PutVarint(buf, nodeId0)
 				val := append(g.pk, buf...)
 				val = append(val, ph...)
-				hash1 := sha3.Sum256(val)
+				hash1 := g.params.sum(val)
 
 				ph = append(parent0.H, parent1_1.H...)
 				binary.PutVarint(buf, nodeId1)
 				val = append(g.pk, buf...)
 				val = append(val, ph...)
-				hash2 := sha3.Sum256(val)
+				hash2 := g.params.sum(val)
 
-				g.NewNode(nodeId0, hash1[:])
-				g.NewNode(nodeId1, hash2[:])
+				g.NewNode(nodeId0, hash1)
+				g.NewNode(nodeId1, hash2)
 				count += 2
 			}
 		}
@@ -440,9 +442,9 @@ func (g *Graph) XiGraph(index int64, count *int64) {
 			buf := make([]byte, hashSize)
 			binary.PutVarint(buf, *count)
 			val := append(g.pk, buf...)
-			hash := sha3.Sum256(val)
+			hash := g.params.sum(val)
 
-			g.NewNode(*count, hash[:])
+			g.NewNode(*count, hash)
 			*count++
 		}
 	}
@@ -471,9 +473,9 @@ func (g *Graph) XiGraph(index int64, count *int64) {
 		binary.PutVarint(buf, *count)
 		val := append(g.pk, buf...)
 		val = append(val, ph...)
-		hash := sha3.Sum256(val)
+		hash := g.params.sum(val)
 
-		g.NewNode(*count, hash[:])
+		g.NewNode(*count, hash)
 		*count++
 	}
 
@@ -487,9 +489,9 @@ func (g *Graph) XiGraph(index int64, count *int64) {
 		binary.PutVarint(buf, nodeId)
 		val := append(g.pk, buf...)
 		val = append(val, parent.H...)
-		hash := sha3.Sum256(val)
+		hash := g.params.sum(val)
 
-		g.NewNode(nodeId, hash[:])
+		g.NewNode(nodeId, hash)
 		*count++
 	}
 
@@ -503,9 +505,9 @@ func (g *Graph) XiGraph(index int64, count *int64) {
 		binary.PutVarint(buf, nodeId)
 		val := append(g.pk, buf...)
 		val = append(val, parent.H...)
-		hash := sha3.Sum256(val)
+		hash := g.params.sum(val)
 
-		g.NewNode(nodeId, hash[:])
+		g.NewNode(nodeId, hash)
 		*count++
 	}
 
@@ -519,9 +521,9 @@ func (g *Graph) XiGraph(index int64, count *int64) {
 		binary.PutVarint(buf, nodeId)
 		val := append(g.pk, buf...)
 		val = append(val, parent.H...)
-		hash := sha3.Sum256(val)
+		hash := g.params.sum(val)
 
-		g.NewNode(nodeId, hash[:])
+		g.NewNode(nodeId, hash)
 		*count++
 	}
 
@@ -541,16 +543,16 @@ func (g *Graph) XiGraph(index int64, count *int64) {
 		binary.PutVarint(buf, nodeId0)
 		val := append(g.pk, buf...)
 		val = append(val, ph...)
-		hash1 := sha3.Sum256(val)
+		hash1 := g.params.sum(val)
 
 		ph = append(parent0.H, parent1_1.H...)
 		binary.PutVarint(buf, nodeId1)
 		val = append(g.pk, buf...)
 		val = append(val, ph...)
-		hash2 := sha3.Sum256(val)
+		hash2 := g.params.sum(val)
 
-		g.NewNode(nodeId0, hash1[:])
-		g.NewNode(nodeId1, hash2[:])
+		g.NewNode(nodeId0, hash1)
+		g.NewNode(nodeId1, hash2)
 		*count += 2
 	}
 }
@@ -0,0 +1,144 @@
+package pos
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/kwonalbert/spacemint/util"
+	"golang.org/x/crypto/sha3"
+)
+
+// Largest graph index accepted from others; the graph sizes of
+// larger indexes get close to overflowing int64
+const MaxIndex = 40
+
+// Rules for how many challenges are asked per round
+const (
+	BetaLog2  = iota // beta * log2(size) challenges, as in the PoS paper
+	BetaFixed        // exactly beta challenges
+)
+
+// Graph families the proof of space can be built on
+const (
+	Xi = iota // PTC76 graphs; see README
+)
+
+// Security parameters shared by the prover, verifier and client
+type Params struct {
+	Beta  int         // challenge multiplier
+	Rule  int         // how Beta turns into a number of challenges
+	Hash  crypto.Hash // hash used for labels and the merkle tree
+	Graph int         // graph family
+}
+
+// Preset parameters
+var (
+	// What the prototype always used: 30 * log2 challenges
+	DefaultParams = Params{
+		Beta:  30,
+		Rule:  BetaLog2,
+		Hash:  crypto.SHA3_256,
+		Graph: Xi,
+	}
+	// Few challenges; only meant for tests and local experiments
+	TestParams = Params{
+		Beta:  2,
+		Rule:  BetaLog2,
+		Hash:  crypto.SHA3_256,
+		Graph: Xi,
+	}
+)
+
+var presets = map[string]*Params{
+	"default": &DefaultParams,
+	"test":    &TestParams,
+}
+
+// Return a copy of the named preset
+func Preset(name string) (*Params, error) {
+	p, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("pos: unknown params preset %q", name)
+	}
+	res := *p
+	return &res, nil
+}
+
+// Derive parameters from a target soundness error, assuming the
+// adversary stores at most fraction of the graph
+func NewParams(soundness, fraction float64) (*Params, error) {
+	beta, err := NumChallenges(soundness, fraction)
+	if err != nil {
+		return nil, err
+	}
+	p := DefaultParams
+	p.Beta = beta
+	p.Rule = BetaFixed
+	return &p, nil
+}
+
+// Number of challenges needed so that a prover that only stores
+// fraction of the graph passes with probability at most soundness.
+// Each challenge is answered correctly with probability at most fraction.
+func NumChallenges(soundness, fraction float64) (int, error) {
+	if soundness <= 0 || soundness >= 1 {
+		return 0, errors.New("pos: soundness must be in (0, 1)")
+	}
+	if fraction <= 0 || fraction >= 1 {
+		return 0, errors.New("pos: storage fraction must be in (0, 1)")
+	}
+	n := math.Ceil(math.Log(soundness) / math.Log(fraction))
+	return int(n), nil
+}
+
+// Check that the parameters are supported by this implementation
+func (p *Params) Validate() error {
+	if p.Beta <= 0 {
+		return errors.New("pos: beta must be positive")
+	}
+	if p.Rule != BetaLog2 && p.Rule != BetaFixed {
+		return fmt.Errorf("pos: unknown challenge rule %d", p.Rule)
+	}
+	if p.Graph != Xi {
+		return fmt.Errorf("pos: unsupported graph family %d", p.Graph)
+	}
+	if !p.Hash.Available() || p.Hash.Size() != hashSize {
+		return fmt.Errorf("pos: unsupported hash %v", p.Hash)
+	}
+	return nil
+}
+
+// Number of challenges per round for the graph of index
+func (p *Params) Challenges(index int64) int {
+	if p.Rule == BetaFixed {
+		return p.Beta
+	}
+	_, _, log2 := dims(index)
+	return p.Beta * int(log2)
+}
+
+// Hash val with the parameter's hash function
+func (p *Params) sum(val []byte) []byte {
+	if p.Hash == crypto.SHA3_256 {
+		hash := sha3.Sum256(val)
+		return hash[:]
+	}
+	h := p.Hash.New()
+	h.Write(val)
+	return h.Sum(nil)
+}
+
+// return: number of nodes, and the next closest power of 2 and log
+//         of the graph of index
+func dims(index int64) (int64, int64, int64) {
+	size := numXi(index)
+	log2 := util.Log2(size) + 1
+	pow2 := int64(1 << uint64(log2))
+	if (1 << uint64(log2-1)) == size {
+		log2--
+		pow2 = 1 << uint64(log2)
+	}
+	return size, pow2, log2
+}
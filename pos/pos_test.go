@@ -1,6 +1,7 @@
 package pos
 
 import (
+	"bytes"
 	"crypto/rand"
 	"flag"
 	"fmt"
@@ -8,7 +9,6 @@ import (
 	"os"
 	"runtime"
 	"testing"
-	"time"
 )
 
 //exp* gets setup in test.go
@@ -17,7 +17,7 @@ var verifier *Verifier = nil
 var pk []byte
 var index int64 = 3
 var size int64 = 0
-var beta int = 30
+var params *Params = &DefaultParams
 var graphDir string = "Xi"
 var name string = "G"
 
@@ -25,15 +25,75 @@ func TestPoS(t *testing.T) {
 	seed := make([]byte, 64)
 	rand.Read(seed)
 	challenges := verifier.SelectChallenges(seed)
-	now := time.Now()
 	hashes, parents, proofs, pProofs := prover.ProveSpace(challenges)
-	fmt.Printf("Prove: %f\n", time.Since(now).Seconds())
-
-	now = time.Now()
 	if !verifier.VerifySpace(challenges, hashes, parents, proofs, pProofs) {
 		log.Fatal("Verify space failed:", challenges)
 	}
-	fmt.Printf("Verify: %f\n", time.Since(now).Seconds())
+}
+
+func TestStorage(t *testing.T) {
+	shards := []Storage{NewMemStorage(), NewMemStorage(), NewMemStorage()}
+	sharded, err := NewShardedStorage(shards, 3*NodeSize+5)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, db := range []Storage{NewMemStorage(), sharded} {
+		p := NewProverStorage(pk, index, name, db, params)
+		commit := p.Init()
+		if !bytes.Equal(commit.Commit, prover.commit) {
+			log.Fatalf("%T gave a different commitment", db)
+		}
+		size, err := db.Size()
+		if err != nil || size != params.Estimate(index).PlotSize {
+			log.Fatalf("%T has the wrong size: %d", db, size)
+		}
+
+		// reopening must not regenerate the graph
+		p = NewProverStorage(pk, index, name, db, params)
+		if !bytes.Equal(p.PreInit().Commit, prover.commit) {
+			log.Fatalf("%T lost the commitment", db)
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	est := params.Estimate(index)
+	challenges := verifier.SelectChallenges([]byte("estimate"))
+	if len(challenges) != est.Challenges {
+		log.Fatal("Wrong number of challenges:", len(challenges), est.Challenges)
+	}
+
+	size := params.ProofSize(index, challenges)
+	actual := ProofSize(prover.ProveSpace(challenges))
+	if size != int64(actual) || size > est.ProofSize {
+		log.Fatal("Wrong proof size:", size, actual, est.ProofSize)
+	}
+	if params.VerifyHashes(index, challenges) > est.VerifyHashes {
+		log.Fatal("Verify hashes above the estimate")
+	}
+
+	stat, err := os.Stat(graphDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stat.Size() != est.PlotSize {
+		log.Fatal("Wrong plot size:", stat.Size(), est.PlotSize)
+	}
+}
+
+func TestNumChallenges(t *testing.T) {
+	// 0.5^20 < 2^-20 <= 0.5^19
+	n, err := NumChallenges(1.0/(1<<20), 0.5)
+	if err != nil || n != 20 {
+		log.Fatal("NumChallenges failed:", n, err)
+	}
+	p, err := NewParams(1.0/(1<<20), 0.5)
+	if err != nil || p.Challenges(index) != n {
+		log.Fatal("NewParams failed:", p, err)
+	}
+	if _, err := NumChallenges(0.01, 1); err == nil {
+		log.Fatal("NumChallenges accepted a full storage fraction")
+	}
 }
 
 func TestMain(m *testing.M) {
@@ -49,16 +109,11 @@ func TestMain(m *testing.M) {
 	graphDir = fmt.Sprintf("%s%d", graphDir, *id)
 	//os.RemoveAll(graphDir)
 
-	now := time.Now()
-	prover = NewProver(pk, index, name, graphDir)
-	fmt.Printf("%d. Graph gen: %fs\n", index, time.Since(now).Seconds())
-
-	now = time.Now()
+	prover = NewProver(pk, index, name, graphDir, params)
 	commit := prover.Init()
-	fmt.Printf("%d. Graph commit: %fs\n", index, time.Since(now).Seconds())
 
 	root := commit.Commit
-	verifier = NewVerifier(pk, index, beta, root)
+	verifier = NewVerifier(pk, index, params, root)
 
 	os.Exit(m.Run())
 }
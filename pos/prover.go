@@ -3,7 +3,6 @@ package pos
 import (
 	//"fmt"
 	"github.com/kwonalbert/spacemint/util"
-	"golang.org/x/crypto/sha3"
 )
 
 type Prover struct {
@@ -18,6 +17,8 @@ type Prover struct {
 	pow2  int64 // next closest power of 2
 	log2  int64 // next closest log
 	empty map[int64]bool
+
+	params *Params
 }
 
 type Commitment struct {
@@ -25,16 +26,22 @@ type Commitment struct {
 	Commit []byte
 }
 
-func NewProver(pk []byte, index int64, name, graph string) *Prover {
-	size := numXi(index)
-	log2 := util.Log2(size) + 1
-	pow2 := int64(1 << uint64(log2))
-	if (1 << uint64(log2-1)) == size {
-		log2--
-		pow2 = 1 << uint64(log2)
+func NewProver(pk []byte, index int64, name, graph string, params *Params) *Prover {
+	db, err := OpenFile(graph)
+	if err != nil {
+		panic(err)
+	}
+	return NewProverStorage(pk, index, name, db, params)
+}
+
+// Prover whose graph lives in db instead of a local file
+func NewProverStorage(pk []byte, index int64, name string, db Storage, params *Params) *Prover {
+	if err := params.Validate(); err != nil {
+		panic(err)
 	}
+	size, pow2, log2 := dims(index)
 
-	g := NewGraph(index, size, pow2, log2, graph, pk)
+	g := NewGraphStorage(index, size, pow2, log2, db, pk, params)
 
 	empty := make(map[int64]bool)
 
@@ -55,6 +62,8 @@ func NewProver(pk []byte, index int64, name, graph string) *Prover {
 		pow2:  pow2,
 		log2:  log2,
 		empty: empty,
+
+		params: params,
 	}
 	return &p
 }
@@ -141,11 +150,11 @@ func (p *Prover) generateMerkle() []byte {
 			hash1 := hashStack[len(hashStack)-1]
 			hashStack = hashStack[:len(hashStack)-1]
 			val := append(hash1[:], hash2[:]...)
-			hash := sha3.Sum256(val)
+			hash := p.params.sum(val)
 
-			hashStack = append(hashStack, hash[:])
+			hashStack = append(hashStack, hash)
 
-			p.graph.NewNodeById(count, hash[:])
+			p.graph.NewNodeById(count, hash)
 			count++
 		}
 		cur = 2 * p.pow2
@@ -210,3 +219,23 @@ func (p *Prover) ProveSpace(challenges []int64) ([][]byte, [][][]byte, [][][]byt
 	}
 	return hashes, parents, proofs, pProofs
 }
+
+// return: number of bytes in a proof returned by ProveSpace
+func ProofSize(hashes [][]byte, parents [][][]byte, proofs [][][]byte, pProofs [][][][]byte) int {
+	size := 0
+	for i := range hashes {
+		size += len(hashes[i])
+		for j := range parents[i] {
+			size += len(parents[i][j])
+		}
+		for j := range proofs[i] {
+			size += len(proofs[i][j])
+		}
+		for j := range pProofs[i] {
+			for k := range pProofs[i][j] {
+				size += len(pProofs[i][j][k])
+			}
+		}
+	}
+	return size
+}
@@ -0,0 +1,193 @@
+package pos
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Storage for the labels and merkle tree of a graph.
+// Nodes are read and written at id * NodeSize.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Size() (int64, error) // 0 for a graph that is not generated yet
+}
+
+// Graph stored in a single local file
+type FileStorage struct {
+	*os.File
+}
+
+// Open the graph file fn, creating it if it doesn't exist
+func OpenFile(fn string) (*FileStorage, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{f}, nil
+}
+
+func (f *FileStorage) Size() (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// Graph kept in memory; mostly for tests
+type MemStorage struct {
+	buf []byte
+}
+
+func NewMemStorage() *MemStorage {
+	return new(MemStorage)
+}
+
+func (m *MemStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("pos: negative offset")
+	}
+	if off >= int64(len(m.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MemStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("pos: negative offset")
+	}
+	end := off + int64(len(p))
+	if end > int64(len(m.buf)) {
+		if end > int64(cap(m.buf)) {
+			buf := make([]byte, end, 2*end)
+			copy(buf, m.buf)
+			m.buf = buf
+		} else {
+			m.buf = m.buf[:end]
+		}
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func (m *MemStorage) Size() (int64, error) {
+	return int64(len(m.buf)), nil
+}
+
+func (m *MemStorage) Close() error {
+	return nil
+}
+
+// Graph striped across several storages, e.g. one file per disk.
+// Consecutive stripes of the graph go to consecutive shards.
+type ShardedStorage struct {
+	shards []Storage
+	stripe int64 // bytes per stripe
+}
+
+func NewShardedStorage(shards []Storage, stripe int64) (*ShardedStorage, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("pos: no shards")
+	}
+	if stripe <= 0 {
+		return nil, errors.New("pos: stripe size must be positive")
+	}
+	s := &ShardedStorage{
+		shards: shards,
+		stripe: stripe,
+	}
+	return s, nil
+}
+
+// Open (or create) a graph striped across the files fns
+func OpenSharded(fns []string, stripe int64) (*ShardedStorage, error) {
+	shards := make([]Storage, len(fns))
+	for i := range fns {
+		f, err := OpenFile(fns[i])
+		if err != nil {
+			for j := 0; j < i; j++ {
+				shards[j].Close()
+			}
+			return nil, err
+		}
+		shards[i] = f
+	}
+	return NewShardedStorage(shards, stripe)
+}
+
+// return: the shard holding off, and the offset within the shard
+func (s *ShardedStorage) locate(off int64) (Storage, int64) {
+	n := int64(len(s.shards))
+	stripe := off / s.stripe
+	local := (stripe/n)*s.stripe + off%s.stripe
+	return s.shards[stripe%n], local
+}
+
+// Split an access of p at off along the stripe boundaries
+func (s *ShardedStorage) split(p []byte, off int64, f func(Storage, []byte, int64) (int, error)) (int, error) {
+	done := 0
+	for done < len(p) {
+		cur := off + int64(done)
+		l := s.stripe - cur%s.stripe
+		if rest := int64(len(p) - done); l > rest {
+			l = rest
+		}
+		shard, local := s.locate(cur)
+		n, err := f(shard, p[done:done+int(l)], local)
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func (s *ShardedStorage) ReadAt(p []byte, off int64) (int, error) {
+	return s.split(p, off, func(shard Storage, b []byte, off int64) (int, error) {
+		return shard.ReadAt(b, off)
+	})
+}
+
+func (s *ShardedStorage) WriteAt(p []byte, off int64) (int, error) {
+	return s.split(p, off, func(shard Storage, b []byte, off int64) (int, error) {
+		return shard.WriteAt(b, off)
+	})
+}
+
+func (s *ShardedStorage) Size() (int64, error) {
+	n := int64(len(s.shards))
+	var size int64
+	for i := range s.shards {
+		l, err := s.shards[i].Size()
+		if err != nil {
+			return 0, err
+		}
+		if l == 0 {
+			continue
+		}
+		// global position of the last byte in this shard
+		stripe := ((l-1)/s.stripe)*n + int64(i)
+		end := stripe*s.stripe + (l-1)%s.stripe + 1
+		if end > size {
+			size = end
+		}
+	}
+	return size, nil
+}
+
+func (s *ShardedStorage) Close() error {
+	var res error
+	for i := range s.shards {
+		if err := s.shards[i].Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
@@ -0,0 +1,117 @@
+package pos
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate testdata/vectors.json")
+
+const vectorFile = "testdata/vectors.json"
+
+// Conformance vectors. Byte strings are base64, as encoding/json does.
+// Labels are listed by node id; the challenges are derived from Seed
+// and answered by the proof.
+type vectorSet struct {
+	Pk      []byte
+	Seed    []byte
+	Beta    int
+	Rule    int
+	Vectors []vector
+}
+
+type vector struct {
+	Index      int64
+	Labels     [][]byte
+	Root       []byte
+	Challenges []int64
+	Hashes     [][]byte
+	Parents    [][][]byte
+	Proofs     [][][]byte
+	PProofs    [][][][]byte
+}
+
+// Generate the vectors for the graph of index from scratch
+func genVector(pk, seed []byte, index int64, params *Params) vector {
+	p := NewProverStorage(pk, index, name, NewMemStorage(), params)
+	commit := p.Init()
+
+	labels := make([][]byte, p.size)
+	for i := range labels {
+		labels[i] = p.graph.GetNode(int64(i) + p.pow2).H
+	}
+
+	v := NewVerifier(pk, index, params, commit.Commit)
+	cs := v.SelectChallenges(seed)
+	hashes, parents, proofs, pProofs := p.ProveSpace(cs)
+	if !v.VerifySpace(cs, hashes, parents, proofs, pProofs) {
+		log.Fatal("Generated proof does not verify:", index)
+	}
+
+	return vector{
+		Index:      index,
+		Labels:     labels,
+		Root:       commit.Commit,
+		Challenges: cs,
+		Hashes:     hashes,
+		Parents:    parents,
+		Proofs:     proofs,
+		PProofs:    pProofs,
+	}
+}
+
+func genVectors() *vectorSet {
+	vs := &vectorSet{
+		Pk:   []byte("spacemint test vector"),
+		Seed: []byte("spacemint test seed"),
+		Beta: TestParams.Beta,
+		Rule: TestParams.Rule,
+	}
+	for index := int64(1); index <= 3; index++ {
+		vs.Vectors = append(vs.Vectors, genVector(vs.Pk, vs.Seed, index, &TestParams))
+	}
+	return vs
+}
+
+func TestVectors(t *testing.T) {
+	got := genVectors()
+	if *update {
+		bin, err := json.MarshalIndent(got, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(vectorFile, append(bin, '\n'), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	bin, err := ioutil.ReadFile(vectorFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exp := new(vectorSet)
+	if err := json.Unmarshal(bin, exp); err != nil {
+		log.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(exp.Pk, got.Pk) || !reflect.DeepEqual(exp.Seed, got.Seed) ||
+		exp.Beta != got.Beta || exp.Rule != got.Rule {
+		log.Fatal("Vector parameters differ from", vectorFile)
+	}
+	if len(exp.Vectors) != len(got.Vectors) {
+		log.Fatal("Number of vectors differ:", len(exp.Vectors), len(got.Vectors))
+	}
+	for i := range exp.Vectors {
+		e, g := reflect.ValueOf(exp.Vectors[i]), reflect.ValueOf(got.Vectors[i])
+		for j := 0; j < e.NumField(); j++ {
+			if !reflect.DeepEqual(e.Field(j).Interface(), g.Field(j).Interface()) {
+				log.Fatalf("Vector %d: %s differs from %s",
+					exp.Vectors[i].Index, e.Type().Field(j).Name, vectorFile)
+			}
+		}
+	}
+}
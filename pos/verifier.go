@@ -3,14 +3,13 @@ package pos
 import (
 	"encoding/binary"
 	//"fmt"
-	"github.com/kwonalbert/spacemint/util"
 	"golang.org/x/crypto/sha3"
 )
 
 type Verifier struct {
-	pk   []byte // public key to verify the proof
-	beta int    // number of challenges needed
-	root []byte // root hash
+	pk     []byte  // public key to verify the proof
+	params *Params // decides the number of challenges needed
+	root   []byte  // root hash
 
 	graph *Graph
 	index int64 // index of the graphy in the family
@@ -19,27 +18,25 @@ type Verifier struct {
 	log2  int64
 }
 
-func NewVerifier(pk []byte, index int64, beta int, root []byte) *Verifier {
-	size := numXi(index)
-	log2 := util.Log2(size) + 1
-	pow2 := int64(1 << uint64(log2))
-	if (1 << uint64(log2-1)) == size {
-		log2--
-		pow2 = 1 << uint64(log2)
+func NewVerifier(pk []byte, index int64, params *Params, root []byte) *Verifier {
+	if err := params.Validate(); err != nil {
+		panic(err)
 	}
+	size, pow2, log2 := dims(index)
 
 	graph := &Graph{
-		pk:    pk,
-		index: index,
-		log2:  log2,
-		pow2:  pow2,
-		size:  size,
+		pk:     pk,
+		index:  index,
+		log2:   log2,
+		pow2:   pow2,
+		size:   size,
+		params: params,
 	}
 
 	v := Verifier{
-		pk:   pk,
-		beta: beta,
-		root: root,
+		pk:     pk,
+		params: params,
+		root:   root,
 
 		graph: graph,
 		index: index,
@@ -53,8 +50,9 @@ func NewVerifier(pk []byte, index int64, beta int, root []byte) *Verifier {
 //TODO: need to select based on some pseudorandomness/gamma function?
 //      Note that these challenges are different from those of cryptocurrency
 func (v *Verifier) SelectChallenges(seed []byte) []int64 {
-	challenges := make([]int64, v.beta*int(v.log2))
-	rands := make([]byte, v.beta*int(v.log2)*8)
+	num := v.params.Challenges(v.index)
+	challenges := make([]int64, num)
+	rands := make([]byte, num*8)
 	sha3.ShakeSum256(rands, seed) //PRNG
 	for i := range challenges {
 		val, num := binary.Uvarint(rands[i*8 : (i+1)*8])
@@ -67,14 +65,24 @@ func (v *Verifier) SelectChallenges(seed []byte) []int64 {
 }
 
 func (v *Verifier) VerifySpace(challenges []int64, hashes [][]byte, parents [][][]byte, proofs [][][]byte, pProofs [][][][]byte) bool {
+	if len(hashes) != len(challenges) || len(parents) != len(challenges) ||
+		len(proofs) != len(challenges) || len(pProofs) != len(challenges) {
+		return false
+	}
 	for i := range challenges {
+		ps := v.graph.GetParents(challenges[i], v.index)
+		if len(hashes[i]) != hashSize || len(parents[i]) != len(ps) ||
+			len(pProofs[i]) != len(ps) {
+			return false
+		}
+
 		buf := make([]byte, hashSize)
 		binary.PutVarint(buf, challenges[i]+v.pow2)
 		val := append(v.pk, buf...)
 		for _, ph := range parents[i] {
 			val = append(val, ph...)
 		}
-		exp := sha3.Sum256(val)
+		exp := v.params.sum(val)
 		for j := range exp {
 			if exp[j] != hashes[i][j] {
 				return false
@@ -84,7 +92,6 @@ func (v *Verifier) VerifySpace(challenges []int64, hashes [][]byte, parents [][]
 			return false
 		}
 
-		ps := v.graph.GetParents(challenges[i], v.index)
 		for j := range ps {
 			if !v.Verify(ps[j], parents[i][j], pProofs[i][j]) {
 				return false
@@ -95,6 +102,9 @@ func (v *Verifier) VerifySpace(challenges []int64, hashes [][]byte, parents [][]
 }
 
 func (v *Verifier) Verify(node int64, hash []byte, proof [][]byte) bool {
+	if int64(len(proof)) != v.log2 {
+		return false
+	}
 	curHash := hash
 	counter := 0
 	for i := node + v.pow2; i > 1; i /= 2 {
@@ -104,15 +114,16 @@ func (v *Verifier) Verify(node int64, hash []byte, proof [][]byte) bool {
 		} else {
 			val = append(proof[counter], curHash...)
 		}
-		hash := sha3.Sum256(val)
-		curHash = hash[:]
+		curHash = v.params.sum(val)
 		counter++
 	}
+	if len(v.root) != len(curHash) {
+		return false
+	}
 	for i := range v.root {
 		if v.root[i] != curHash[i] {
 			return false
 		}
 	}
-
-	return len(v.root) == len(curHash)
+	return true
 }
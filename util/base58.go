@@ -0,0 +1,61 @@
+package util
+
+import (
+	"errors"
+	"math/big"
+)
+
+// Base58, with the alphabet used by Bitcoin: no 0, O, I or l, so
+// strings are easy to copy by hand. Every leading zero byte becomes a
+// leading '1'.
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var base58Digits = func() [256]int8 {
+	var ds [256]int8
+	for i := range ds {
+		ds[i] = -1
+	}
+	for i := 0; i < len(base58Alphabet); i++ {
+		ds[base58Alphabet[i]] = int8(i)
+	}
+	return ds
+}()
+
+// return: b in base58
+func EncodeBase58(b []byte) string {
+	x := new(big.Int).SetBytes(b)
+	base := big.NewInt(58)
+	mod := new(big.Int)
+	var res []byte
+	for x.Sign() > 0 {
+		x.DivMod(x, base, mod)
+		res = append(res, base58Alphabet[mod.Int64()])
+	}
+	for i := 0; i < len(b) && b[i] == 0; i++ {
+		res = append(res, base58Alphabet[0])
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return string(res)
+}
+
+// return: the bytes that EncodeBase58 turned into s
+func DecodeBase58(s string) ([]byte, error) {
+	x := new(big.Int)
+	base := big.NewInt(58)
+	for i := 0; i < len(s); i++ {
+		d := base58Digits[s[i]]
+		if d < 0 {
+			return nil, errors.New("util: bad base58 character")
+		}
+		x.Mul(x, base)
+		x.Add(x, big.NewInt(int64(d)))
+	}
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), x.Bytes()...), nil
+}
@@ -29,25 +29,32 @@ func Pow(x *big.Float, n int64) *big.Float {
 
 // Implements the nth root algorithm from
 // https://en.wikipedia.org/wiki/Nth_root_algorithm
-// return: nth root of x within some epsilon
+// return: nth root of x within some epsilon, relative to the root so
+//         that large x converge too
 func Root(x *big.Float, n int64) *big.Float {
 	guess := new(big.Float).Quo(x, big.NewFloat(float64(n)))
-	diff := big.NewFloat(1)
 	ep := big.NewFloat(0.00000001)
-	abs := new(big.Float).Abs(diff)
-	for abs.Cmp(ep) >= 0 {
-		//fmt.Println(guess, abs)
+	// newton's method converges long before maxRootIter; the cap only
+	// guards against guesses that oscillate in the last bits
+	for i := 0; i < maxRootIter; i++ {
 		prev := Pow(guess, n-1)
-		diff = new(big.Float).Quo(x, prev)
+		diff := new(big.Float).Quo(x, prev)
 		diff = diff.Sub(diff, guess)
 		diff = diff.Quo(diff, big.NewFloat(float64(n)))
 
 		guess = guess.Add(guess, diff)
-		abs = new(big.Float).Abs(diff)
+		abs := new(big.Float).Abs(diff)
+		bound := new(big.Float).Abs(guess)
+		bound = bound.Mul(bound, ep)
+		if abs.Cmp(bound) < 0 {
+			break
+		}
 	}
 	return guess
 }
 
+const maxRootIter = 10000
+
 //return: floor log base 2 of x
 func Log2(x int64) int64 {
 	var r int64 = 0
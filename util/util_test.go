@@ -8,7 +8,7 @@ import (
 
 func TestPow(t *testing.T) {
 	x := big.NewFloat(0.12381245613960218386)
-	n := 3
+	var n int64 = 3
 	res := Pow(x, n)
 	exp := big.NewFloat(0.00189798605)
 	diff := new(big.Float).Sub(res, exp)
@@ -20,7 +20,7 @@ func TestPow(t *testing.T) {
 
 func TestRoot(t *testing.T) {
 	x := big.NewFloat(0.12381245613960218386)
-	n := 16
+	var n int64 = 16
 	res := Root(x, n)
 	exp := big.NewFloat(0.8776023372475015)
 	diff := new(big.Float).Sub(res, exp)
@@ -29,3 +29,25 @@ func TestRoot(t *testing.T) {
 		log.Fatal("Exp failed:", exp, res)
 	}
 }
+
+func TestBase58(t *testing.T) {
+	vectors := map[string]string{
+		"":                 "",
+		"\x00":             "1",
+		"\x00\x00\x01":     "112",
+		"hello world":      "StV1DL6CwTryKyV",
+		"\x00\xff\x00\x10": "12Ueoh",
+	}
+	for in, exp := range vectors {
+		if res := EncodeBase58([]byte(in)); res != exp {
+			log.Fatal("EncodeBase58 failed:", exp, res)
+		}
+		res, err := DecodeBase58(exp)
+		if err != nil || string(res) != in {
+			log.Fatal("DecodeBase58 failed:", []byte(in), res, err)
+		}
+	}
+	if _, err := DecodeBase58("0OIl"); err == nil {
+		log.Fatal("Decoded characters outside the alphabet")
+	}
+}
@@ -0,0 +1,389 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/kwonalbert/spacemint/block"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Implements a wallet: signing keys kept encrypted on disk, and the
+// coins paid to them.
+//
+// The keys are sealed with AES-256-GCM, under a key derived from the
+// passphrase with scrypt. Every save uses a fresh salt and nonce.
+
+// version of the wallet file
+const walletVersion = 1
+
+// scrypt costs for new saves; opening uses the costs in the file
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Highest scrypt costs Open accepts, so that a tampered file can't make
+// it use all memory or run for hours
+const (
+	maxScryptN = 1 << 20
+	maxScryptR = 32
+	maxScryptP = 16
+)
+
+// The wallet file
+type sealed struct {
+	Version int
+	N, R, P int    // scrypt costs
+	Salt    []byte // for scrypt
+	Nonce   []byte // for GCM
+	Keys    []byte // PKCS #8 keys, sealed
+}
+
+type Wallet struct {
+	fn     string
+	pass   []byte
+	keys   []crypto.Signer
+	pks    [][]byte // encoded public key of each key
+	hashes [][]byte // pk hash of each key
+}
+
+var errNoPassphrase = errors.New("wallet: empty passphrase")
+
+// Create an empty wallet in fn, which must not exist yet, encrypted
+// under pass, which must not be empty
+func Create(fn string, pass []byte) (*Wallet, error) {
+	if len(pass) == 0 {
+		return nil, errNoPassphrase
+	}
+	if _, err := os.Stat(fn); err == nil {
+		return nil, fmt.Errorf("wallet: %s already exists", fn)
+	}
+	w := &Wallet{fn: fn, pass: pass}
+	if err := w.Save(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Open the wallet in fn, which Save wrote with pass
+func Open(fn string, pass []byte) (*Wallet, error) {
+	bin, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var s sealed
+	if err := json.Unmarshal(bin, &s); err != nil {
+		return nil, err
+	}
+	if s.Version != walletVersion {
+		return nil, fmt.Errorf("wallet: unknown wallet version %d", s.Version)
+	}
+	if s.N > maxScryptN || s.R > maxScryptR || s.P > maxScryptP {
+		return nil, fmt.Errorf("wallet: scrypt costs N=%d r=%d p=%d are too high", s.N, s.R, s.P)
+	}
+	aead, err := newAEAD(pass, s.Salt, s.N, s.R, s.P)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, s.Nonce, s.Keys, []byte{walletVersion})
+	if err != nil {
+		return nil, errors.New("wallet: wrong passphrase or corrupt wallet")
+	}
+	var ders [][]byte
+	if err := json.Unmarshal(plain, &ders); err != nil {
+		return nil, err
+	}
+
+	w := &Wallet{fn: fn, pass: pass}
+	for _, der := range ders {
+		k, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		sk, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("wallet: key can't sign")
+		}
+		if err := w.add(sk); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func newAEAD(pass, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(pass, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+// Write the wallet to its file, replacing it atomically
+func (w *Wallet) Save() error {
+	ders := make([][]byte, len(w.keys))
+	for i, sk := range w.keys {
+		der, err := x509.MarshalPKCS8PrivateKey(sk)
+		if err != nil {
+			return err
+		}
+		ders[i] = der
+	}
+	plain, err := json.Marshal(ders)
+	if err != nil {
+		return err
+	}
+
+	s := sealed{
+		Version: walletVersion,
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, 32),
+	}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(w.pass, s.Salt, s.N, s.R, s.P)
+	if err != nil {
+		return err
+	}
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return err
+	}
+	s.Keys = aead.Seal(nil, s.Nonce, plain, []byte{walletVersion})
+
+	bin, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	tmp := w.fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, bin, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.fn)
+}
+
+// Encrypt the wallet under pass, which must not be empty, from now on
+func (w *Wallet) ChangePassphrase(pass []byte) error {
+	if len(pass) == 0 {
+		return errNoPassphrase
+	}
+	old := w.pass
+	w.pass = pass
+	if err := w.Save(); err != nil {
+		w.pass = old
+		return err
+	}
+	return nil
+}
+
+// Generate a key for one of the block.Key algorithms, and save it
+// return: the encoded public key
+func (w *Wallet) NewKey(alg int) ([]byte, error) {
+	sk, err := block.GenerateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.add(sk); err != nil {
+		return nil, err
+	}
+	if err := w.Save(); err != nil {
+		n := len(w.keys) - 1
+		w.keys, w.pks, w.hashes = w.keys[:n], w.pks[:n], w.hashes[:n]
+		return nil, err
+	}
+	return w.pks[len(w.pks)-1], nil
+}
+
+func (w *Wallet) add(sk crypto.Signer) error {
+	pk, err := block.EncodePublicKey(sk.Public())
+	if err != nil {
+		return err
+	}
+	w.keys = append(w.keys, sk)
+	w.pks = append(w.pks, pk)
+	w.hashes = append(w.hashes, block.PkHash(pk))
+	return nil
+}
+
+// return: the encoded public keys of the wallet, oldest first
+func (w *Wallet) Keys() [][]byte {
+	return append([][]byte(nil), w.pks...)
+}
+
+// return: the addresses of the wallet's keys on network net, oldest
+//         first
+func (w *Wallet) Addresses(net *block.ChainParams) []string {
+	res := make([]string, len(w.hashes))
+	for i := range w.hashes {
+		res[i] = net.EncodeAddress(w.hashes[i])
+	}
+	return res
+}
+
+// return: the key of encoded public key pk, if the wallet has it
+func (w *Wallet) Signer(pk []byte) (crypto.Signer, bool) {
+	for i := range w.pks {
+		if bytes.Equal(w.pks[i], pk) {
+			return w.keys[i], true
+		}
+	}
+	return nil, false
+}
+
+// return: the key whose pk hash is hash, if the wallet has it
+func (w *Wallet) signerOf(hash []byte) (crypto.Signer, bool) {
+	for i := range w.hashes {
+		if bytes.Equal(w.hashes[i], hash) {
+			return w.keys[i], true
+		}
+	}
+	return nil, false
+}
+
+// return: the unspent outputs in u paying the wallet's keys
+func (w *Wallet) Unspent(u *block.UTXOSet) []block.Unspent {
+	var res []block.Unspent
+	for _, hash := range w.hashes {
+		res = append(res, u.ByPkHash(hash)...)
+	}
+	return res
+}
+
+// return: the coins in u paid to the wallet's keys, in base units
+func (w *Wallet) Balance(u *block.UTXOSet) uint64 {
+	var sum uint64
+	for _, out := range w.Unspent(u) {
+		sum += out.Coins
+	}
+	return sum
+}
+
+// Build and sign a payment of amount to address to on network net,
+// paying fee, from the outputs in u that no payment in pool spends
+// yet; pool may be nil. The largest outputs are spent first, and the
+// change goes back to the key of the first one.
+func (w *Wallet) Pay(net *block.ChainParams, u *block.UTXOSet, pool *block.Mempool, to string, amount, fee uint64) (*block.Transaction, error) {
+	hash, err := net.DecodeAddress(to)
+	if err != nil {
+		return nil, err
+	}
+	if amount == 0 {
+		return nil, errors.New("wallet: nothing to pay")
+	}
+	need := amount + fee
+	if need < amount {
+		return nil, errors.New("wallet: amount overflows")
+	}
+
+	var outs []block.Unspent
+	for _, out := range w.Unspent(u) {
+		if pool == nil || !pool.Spends(out.Tid, out.K) {
+			outs = append(outs, out)
+		}
+	}
+	sort.SliceStable(outs, func(i, j int) bool {
+		return outs[i].Coins > outs[j].Coins
+	})
+	var have uint64
+	n := 0
+	for n < len(outs) && have < need {
+		have += outs[n].Coins
+		n++
+	}
+	if have < need {
+		return nil, fmt.Errorf("wallet: %d available; %d needed", have, need)
+	}
+
+	t := &block.Transaction{
+		Type: block.Payment,
+		Out:  []block.Out{{PkHash: hash, Coins: amount}},
+	}
+	for _, out := range outs[:n] {
+		t.In = append(t.In, block.In{Tid: out.Tid, K: out.K})
+	}
+	if have > need {
+		t.Out = append(t.Out, block.Out{PkHash: outs[0].PkHash, Coins: have - need})
+	}
+	for i, out := range outs[:n] {
+		sk, _ := w.signerOf(out.PkHash)
+		if err := t.SignIn(i, sk); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// What a transaction on the chain did to the wallet's coins
+type Entry struct {
+	Height   int    // block the transaction is in
+	Tid      []byte // id of the transaction
+	Type     int    // of the transaction
+	Received uint64 // paid to the wallet's keys
+	Spent    uint64 // taken from the wallet's outputs, or taken back by a punishment
+}
+
+// return: the transactions in the main chain of bc that pay the
+//         wallet, spend from it, or punish one of its keys and take
+//         back its unspent rewards, oldest first
+func (w *Wallet) History(bc *block.BlockChain) ([]Entry, error) {
+	type outpoint struct {
+		tid string
+		k   int
+	}
+	type output struct {
+		block.Out
+		reward bool
+	}
+	ours := make(map[outpoint]output)
+	var res []Entry
+	err := bc.Range(0, bc.LastBlock, func(b *block.Block) bool {
+		for i := range b.Trans {
+			t := &b.Trans[i]
+			e := Entry{Height: b.Id, Tid: t.Id(), Type: t.Type}
+			for _, in := range t.In {
+				op := outpoint{string(in.Tid), in.K}
+				e.Spent += ours[op].Coins
+				delete(ours, op)
+			}
+			if t.Type == block.Punishment {
+				hash := block.PkHash(t.Pk)
+				for op, out := range ours {
+					if out.reward && bytes.Equal(out.PkHash, hash) {
+						e.Spent += out.Coins
+						delete(ours, op)
+					}
+				}
+			}
+			for k, out := range t.Out {
+				if _, ok := w.signerOf(out.PkHash); ok {
+					ours[outpoint{string(e.Tid), k}] = output{out, t.Type == block.Reward}
+					e.Received += out.Coins
+				}
+			}
+			if e.Received != 0 || e.Spent != 0 {
+				res = append(res, e)
+			}
+		}
+		return true
+	})
+	return res, err
+}
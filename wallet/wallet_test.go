@@ -0,0 +1,199 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/kwonalbert/spacemint/block"
+	"github.com/kwonalbert/spacemint/pos"
+)
+
+func TestWallet(t *testing.T) {
+	scryptN = 1 << 10
+	fn := "test.wallet"
+	defer os.Remove(fn)
+	os.Remove(fn)
+
+	if _, err := Create(fn, nil); err == nil {
+		log.Fatal("Created a wallet without a passphrase")
+	}
+	w, err := Create(fn, []byte("pass"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := Create(fn, []byte("pass")); err == nil {
+		log.Fatal("Created over an existing wallet")
+	}
+	if w.ChangePassphrase(nil) == nil {
+		log.Fatal("Removed the passphrase")
+	}
+	pk1, err := w.NewKey(block.KeyEd25519)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := w.NewKey(block.KeyP256); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := Open(fn, []byte("wrong")); err == nil {
+		log.Fatal("Opened with the wrong passphrase")
+	}
+	if err := w.ChangePassphrase([]byte("new")); err != nil {
+		log.Fatal(err)
+	}
+	w2, err := Open(fn, []byte("new"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !reflect.DeepEqual(w.Addresses(&block.MainnetParams), w2.Addresses(&block.MainnetParams)) {
+		log.Fatal("Keys did not survive a reopen")
+	}
+	msg := []byte("message")
+	sk, _ := w2.Signer(pk1)
+	sig, err := block.Sign(sk, msg)
+	if err != nil || !block.Verify(pk1, msg, sig) {
+		log.Fatal("Reopened key does not sign:", err)
+	}
+
+	bin, _ := ioutil.ReadFile(fn)
+	var s sealed
+	if err := json.Unmarshal(bin, &s); err != nil {
+		log.Fatal(err)
+	}
+	s.N = 1 << 30
+	bin, _ = json.Marshal(&s)
+	if err := ioutil.WriteFile(fn, bin, 0600); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := Open(fn, []byte("new")); err == nil {
+		log.Fatal("Opened a wallet with excessive scrypt costs")
+	}
+}
+
+func TestPay(t *testing.T) {
+	scryptN = 1 << 10
+	fn := "pay.wallet"
+	defer os.Remove(fn)
+	os.Remove(fn)
+	w, err := Create(fn, []byte("pass"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	pk, _ := w.NewKey(block.KeyEd25519)
+	other, _ := block.GenerateKey(block.KeyEd25519)
+	opk, _ := block.EncodePublicKey(other.Public())
+	net, _ := block.ChainPreset("regtest")
+	to := net.Address(opk)
+
+	cfn := "wallet.chain"
+	defer func() {
+		os.Remove(cfn)
+		os.Remove(cfn + ".index")
+		os.Remove(cfn + ".commits")
+	}()
+	os.Remove(cfn)
+	chain := block.NewBlockChain(cfn)
+	defer chain.Close()
+	chain.UTXO.Issuance = func(int) uint64 { return 100 }
+
+	reward := block.Transaction{
+		Type: block.Reward,
+		Out:  []block.Out{{PkHash: block.PkHash(pk), Coins: 100}},
+	}
+	b0 := &block.Block{Body: block.Body{Trans: []block.Transaction{reward}}}
+	b0.Proof.Commit.Pk = pk
+	if err := chain.Add(b0); err != nil {
+		log.Fatal(err)
+	}
+	if w.Balance(chain.UTXO) != 100 {
+		log.Fatal("Wrong balance:", w.Balance(chain.UTXO))
+	}
+
+	if _, err := w.Pay(net, chain.UTXO, nil, to, 96, 5); err == nil {
+		log.Fatal("Paid more than the balance")
+	}
+	if _, err := w.Pay(&block.MainnetParams, chain.UTXO, nil, to, 30, 5); err == nil {
+		log.Fatal("Paid an address of another network")
+	}
+	tx, err := w.Pay(net, chain.UTXO, nil, to, 30, 5)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fee, err := chain.UTXO.Validate(tx); err != nil || fee != 5 {
+		log.Fatal("Bad payment:", fee, err)
+	}
+	if len(tx.Out) != 2 || !bytes.Equal(tx.Out[1].PkHash, block.PkHash(pk)) || tx.Out[1].Coins != 65 {
+		log.Fatal("Wrong change:", tx.Out)
+	}
+	pool := block.NewMempool(chain)
+	if err := pool.Accept(tx); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := w.Pay(net, chain.UTXO, pool, to, 10, 1); err == nil {
+		log.Fatal("Paid from an output a pending payment spends")
+	}
+
+	b1 := &block.Block{Header: block.Header{Id: 1}, Body: block.Body{Trans: []block.Transaction{*tx}}}
+	if err := chain.Add(b1); err != nil {
+		log.Fatal(err)
+	}
+	if w.Balance(chain.UTXO) != 65 {
+		log.Fatal("Wrong balance after paying:", w.Balance(chain.UTXO))
+	}
+	hist, err := w.History(chain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exp := []Entry{
+		{Height: 0, Tid: reward.Id(), Type: block.Reward, Received: 100},
+		{Height: 1, Tid: tx.Id(), Type: block.Payment, Received: 65, Spent: 100},
+	}
+	if !reflect.DeepEqual(hist, exp) {
+		log.Fatal("Wrong history:", hist)
+	}
+
+	// a punishment takes back the reward, but not the change
+	reward2 := block.Transaction{
+		Type: block.Reward,
+		J:    2,
+		Out:  []block.Out{{PkHash: block.PkHash(pk), Coins: 100}},
+	}
+	commit := block.Transaction{Type: block.SpaceCommit, Commit: &pos.Commitment{Pk: pk, Commit: []byte{1}}}
+	b2 := &block.Block{Header: block.Header{Id: 2}, Body: block.Body{Trans: []block.Transaction{reward2, commit}}}
+	b2.Proof.Commit.Pk = pk
+	if err := chain.Add(b2); err != nil {
+		log.Fatal(err)
+	}
+	sk, _ := w.Signer(pk)
+	var prf block.PoS
+	prf.Commit.Pk = pk
+	d := block.NewDetector()
+	d.Observe(block.NewBlock(b2, prf, nil, sk))
+	punish := d.Observe(block.NewBlock(b2, prf, []block.Transaction{reward2}, sk))
+	if punish == nil {
+		log.Fatal("No punishment for signing twice")
+	}
+	b3 := &block.Block{Header: block.Header{Id: 3}, Body: block.Body{Trans: []block.Transaction{*punish}}}
+	if err := chain.Add(b3); err != nil {
+		log.Fatal(err)
+	}
+	if w.Balance(chain.UTXO) != 65 {
+		log.Fatal("Wrong balance after a punishment:", w.Balance(chain.UTXO))
+	}
+	hist, err = w.History(chain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exp = append(exp,
+		Entry{Height: 2, Tid: reward2.Id(), Type: block.Reward, Received: 100},
+		Entry{Height: 3, Tid: punish.Id(), Type: block.Punishment, Spent: 100},
+	)
+	if !reflect.DeepEqual(hist, exp) {
+		log.Fatal("Wrong history after a punishment:", hist)
+	}
+}